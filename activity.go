@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const activityFields = "steps,distance,elevation,calories,soft,moderate,intense"
+
+// getActivity returns the daily activity summaries of the days between from
+// and to.
+func getActivity(ctx context.Context, accessToken string, from time.Time, to time.Time) (*Activity, error) {
+	all := &Activity{}
+	offset := 0
+	for {
+		url := fmt.Sprintf("%s/v2/measure?action=getactivity&startdateymd=%s&enddateymd=%s&data_fields=%s",
+			withingsAPIBaseURL, from.Format("2006-01-02"), to.Format("2006-01-02"), activityFields)
+		if offset > 0 {
+			url += fmt.Sprintf("&offset=%d", offset)
+		}
+
+		body, err := withingsRequest(ctx, url, accessToken)
+		if err != nil {
+			return nil, err
+		}
+
+		page := Activity{}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		if page.Status != 0 {
+			return nil, fmt.Errorf("getactivity returned status %d", page.Status)
+		}
+
+		all.Body.Activities = append(all.Body.Activities, page.Body.Activities...)
+		if !page.Body.More || page.Body.Offset <= offset {
+			return all, nil
+		}
+		offset = page.Body.Offset
+	}
+}
+
+// An activity quantity, exposed as a counter that starts from zero every
+// day.
+type activityCounter struct {
+	desc  *prometheus.Desc
+	value func(day activityDay) float64
+}
+
+type activityDay struct {
+	date      string
+	steps     float64
+	distance  float64
+	elevation float64
+	calories  float64
+	soft      float64
+	moderate  float64
+	intense   float64
+}
+
+var activityCounters = []activityCounter{
+	{prometheus.NewDesc("withings_steps_total", "Steps taken today; resets at the start of every day", []string{"user"}, nil), func(d activityDay) float64 { return d.steps }},
+	{prometheus.NewDesc("withings_distance_meters_total", "Distance travelled today; resets at the start of every day", []string{"user"}, nil), func(d activityDay) float64 { return d.distance }},
+	{prometheus.NewDesc("withings_floors_climbed_total", "Floors climbed today; resets at the start of every day", []string{"user"}, nil), func(d activityDay) float64 { return d.elevation }},
+	{prometheus.NewDesc("withings_active_calories_total", "Active calories burned today, in kcal; resets at the start of every day", []string{"user"}, nil), func(d activityDay) float64 { return d.calories }},
+	{prometheus.NewDesc("withings_activity_soft_seconds_total", "Time spent in soft activity today; resets at the start of every day", []string{"user"}, nil), func(d activityDay) float64 { return d.soft }},
+	{prometheus.NewDesc("withings_activity_moderate_seconds_total", "Time spent in moderate activity today; resets at the start of every day", []string{"user"}, nil), func(d activityDay) float64 { return d.moderate }},
+	{prometheus.NewDesc("withings_activity_intense_seconds_total", "Time spent in intense activity today; resets at the start of every day", []string{"user"}, nil), func(d activityDay) float64 { return d.intense }},
+}
+
+// An activity quantity of one day, exposed as a gauge labelled with the date
+// so the final values of yesterday stay visible after midnight.
+type dailyActivityGauge struct {
+	vec   *prometheus.GaugeVec
+	value func(day activityDay) float64
+}
+
+func newDailyActivityGauge(name string, help string, value func(day activityDay) float64) dailyActivityGauge {
+	return dailyActivityGauge{
+		prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, []string{"user", "date"}),
+		value,
+	}
+}
+
+var dailyActivityGauges = []dailyActivityGauge{
+	newDailyActivityGauge("withings_daily_steps", "Steps taken on the date", func(d activityDay) float64 { return d.steps }),
+	newDailyActivityGauge("withings_daily_distance_meters", "Distance travelled on the date", func(d activityDay) float64 { return d.distance }),
+	newDailyActivityGauge("withings_daily_floors_climbed", "Floors climbed on the date", func(d activityDay) float64 { return d.elevation }),
+	newDailyActivityGauge("withings_daily_active_calories", "Active calories burned on the date, in kcal", func(d activityDay) float64 { return d.calories }),
+	newDailyActivityGauge("withings_daily_activity_soft_seconds", "Time spent in soft activity on the date", func(d activityDay) float64 { return d.soft }),
+	newDailyActivityGauge("withings_daily_activity_moderate_seconds", "Time spent in moderate activity on the date", func(d activityDay) float64 { return d.moderate }),
+	newDailyActivityGauge("withings_daily_activity_intense_seconds", "Time spent in intense activity on the date", func(d activityDay) float64 { return d.intense }),
+}
+
+var (
+	activityTodayMu sync.Mutex
+	// Keyed by user.
+	activityToday = map[string]*activityDay{}
+)
+
+// activityCollector exposes today's activity as counters, so rate() and
+// increase() handle the daily reset like any other counter reset.
+type activityCollector struct{}
+
+func (activityCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, counter := range activityCounters {
+		ch <- counter.desc
+	}
+}
+
+func (activityCollector) Collect(ch chan<- prometheus.Metric) {
+	activityTodayMu.Lock()
+	defer activityTodayMu.Unlock()
+
+	for user, day := range activityToday {
+		for _, counter := range activityCounters {
+			ch <- prometheus.MustNewConstMetric(counter.desc, prometheus.CounterValue, counter.value(*day), user)
+		}
+	}
+}
+
+// updateActivityMetrics fetches today's and yesterday's activity, exposes
+// both days as daily gauges and today's as counters, records the daily step counts in store if it is not nil and
+// writes them to the sinks.
+func updateActivityMetrics(ctx context.Context, accessToken string, store *HistoryStore) {
+	now := time.Now()
+	activity, err := getActivity(ctx, accessToken, now.AddDate(0, 0, -1), now)
+	if err != nil {
+		log.Printf("Cannot fetch activity: %v", err)
+		return
+	}
+
+	user := contextUser(ctx)
+	for _, gauge := range dailyActivityGauges {
+		deleteUserSeries(gauge.vec, user)
+	}
+
+	today := &activityDay{date: now.Format("2006-01-02")}
+	var samples []Sample
+	for _, a := range activity.Body.Activities {
+		day, err := time.ParseInLocation("2006-01-02", a.Date, sessionLocation(a.Timezone))
+		if err != nil {
+			continue
+		}
+		samples = append(samples, Sample{User: user, Type: "steps", Time: day, Value: a.Steps})
+
+		d := activityDay{
+			date:  a.Date,
+			steps: a.Steps, distance: a.Distance, elevation: a.Elevation, calories: a.Calories,
+			soft: a.Soft, moderate: a.Moderate, intense: a.Intense,
+		}
+		for _, gauge := range dailyActivityGauges {
+			gauge.vec.WithLabelValues(user, d.date).Set(gauge.value(d))
+		}
+		if a.Date == today.date {
+			*today = d
+		}
+	}
+
+	log.Printf("Setting withings_steps_total metric to %.0f.\n", today.steps)
+	activityTodayMu.Lock()
+	activityToday[user] = today
+	activityTodayMu.Unlock()
+	setLatestValue(ctx, "steps", today.steps)
+
+	if store != nil {
+		if err := store.Add(samples...); err != nil {
+			log.Printf("Cannot update history store: %v", err)
+		}
+		updateAggregateMetrics(store, user)
+	}
+	writeToSinks(ctx, samples)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Classification of an ECG recording, by the value of ecg.afib in the heart
+// list.
+var ecgClassifications = map[int]string{
+	0: "negative",
+	1: "afib",
+	2: "inconclusive",
+}
+
+var ecgRecordingsTotalDesc = prometheus.NewDesc(
+	"withings_ecg_recordings_total",
+	"Number of ECG recordings by classification (negative, afib or inconclusive)",
+	[]string{"user", "classification"}, nil,
+)
+
+var (
+	ecgCountsMu sync.Mutex
+	// Keyed by user, then by classification.
+	ecgCounts = map[string]map[string]int{}
+	// The timestamp of the newest heart list entry of each user.
+	ecgLastSeen = map[string]int64{}
+)
+
+// ecgRecordingsCollector exposes the ECG recording counts as a counter, so
+// increase() can alert on new recordings of a classification.
+type ecgRecordingsCollector struct{}
+
+func (ecgRecordingsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ecgRecordingsTotalDesc
+}
+
+func (ecgRecordingsCollector) Collect(ch chan<- prometheus.Metric) {
+	ecgCountsMu.Lock()
+	defer ecgCountsMu.Unlock()
+
+	for user, counts := range ecgCounts {
+		for classification, count := range counts {
+			ch <- prometheus.MustNewConstMetric(ecgRecordingsTotalDesc, prometheus.CounterValue, float64(count), user, classification)
+		}
+	}
+}
+
+// updateECGMetrics counts the ECG recordings in the heart list by
+// classification, records when atrial fibrillation was last detected and
+// exposes the latest entry's blood pressure and heart rate. After the first
+// poll, only the entries newer than the newest one seen are fetched.
+func updateECGMetrics(ctx context.Context, accessToken string) {
+	user := contextUser(ctx)
+	ecgCountsMu.Lock()
+	lastSeen := ecgLastSeen[user]
+	ecgCountsMu.Unlock()
+
+	var since time.Time
+	if lastSeen > 0 {
+		since = time.Unix(lastSeen+1, 0)
+	}
+	list, err := getHeartList(ctx, accessToken, since)
+	if err != nil {
+		log.Printf("Cannot fetch heart list: %v", err)
+		return
+	}
+
+	counts := map[string]int{}
+	for _, classification := range ecgClassifications {
+		counts[classification] = 0
+	}
+	ecgCountsMu.Lock()
+	for classification, count := range ecgCounts[user] {
+		counts[classification] = count
+	}
+	ecgCountsMu.Unlock()
+
+	var lastAFib int64
+	latest, latestBP := -1, -1
+	previous := lastSeen
+	for i, entry := range list.Body.Series {
+		// Entries already counted.
+		if previous > 0 && entry.Timestamp <= previous {
+			continue
+		}
+		if entry.Timestamp > lastSeen {
+			lastSeen = entry.Timestamp
+		}
+		if latest < 0 || entry.Timestamp > list.Body.Series[latest].Timestamp {
+			latest = i
+		}
+		if entry.BloodPressure.Systole > 0 && (latestBP < 0 || entry.Timestamp > list.Body.Series[latestBP].Timestamp) {
+			latestBP = i
+		}
+		// Blood pressure readings are listed without an ECG.
+		if entry.ECG.SignalID == 0 {
+			continue
+		}
+		recordMeasurementTime(ctx, "ecg", time.Unix(entry.Timestamp, 0))
+
+		classification, ok := ecgClassifications[entry.ECG.AFib]
+		if !ok {
+			continue
+		}
+		counts[classification]++
+
+		if classification == "afib" && entry.Timestamp > lastAFib {
+			lastAFib = entry.Timestamp
+		}
+	}
+
+	ecgCountsMu.Lock()
+	ecgCounts[user] = counts
+	ecgLastSeen[user] = lastSeen
+	ecgCountsMu.Unlock()
+	log.Printf("Setting withings_ecg_recordings_total metric: %d negative, %d afib, %d inconclusive.\n", counts["negative"], counts["afib"], counts["inconclusive"])
+
+	if lastAFib > 0 {
+		afibLastDetectedMetric.WithLabelValues(user).Set(float64(lastAFib))
+	}
+
+	if latestBP >= 0 {
+		entry := list.Body.Series[latestBP]
+		if setBloodPressure(ctx, time.Unix(entry.Timestamp, 0), float64(entry.BloodPressure.Systole), float64(entry.BloodPressure.Diastole)) {
+			recordMeasurementOrigin(ctx, accessToken, "bp", entry.DeviceID, "device")
+		}
+	}
+	if latest >= 0 {
+		entry := list.Body.Series[latest]
+		if entry.HeartRate > 0 {
+			heartReadingHeartRateMetric.WithLabelValues(user).Set(float64(entry.HeartRate))
+		}
+		ecgAvailable := 0.0
+		if entry.ECG.SignalID != 0 {
+			ecgAvailable = 1
+		}
+		heartReadingECGMetric.WithLabelValues(user).Set(ecgAvailable)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// How samples of each type are combined into weekly and monthly aggregates.
+// Types not listed here are not aggregated.
+var aggregateStats = map[string]string{
+	"weight":         "avg",
+	"hydration":      "avg",
+	"steps":          "sum",
+	"sleep_duration": "avg",
+}
+
+var aggregatePeriods = []string{"week", "month"}
+
+// Aggregate summarises the samples of one type within one week or month.
+type Aggregate struct {
+	Type   string    `json:"type"`
+	Period string    `json:"period"`
+	Start  time.Time `json:"start"`
+	Stat   string    `json:"stat"`
+	Value  float64   `json:"value"`
+	Count  int       `json:"count"`
+}
+
+// periodStart returns the start of the week (Monday) or month containing t,
+// in t's location.
+func periodStart(t time.Time, period string) time.Time {
+	year, month, day := t.Date()
+	switch period {
+	case "week":
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-offset, 0, 0, 0, 0, t.Location())
+	case "month":
+		return time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Time{}
+}
+
+// computeAggregates groups samples (oldest first) into periods and combines
+// each group using stat.
+func computeAggregates(measurementType string, samples []Sample, period string, stat string) []Aggregate {
+	var aggregates []Aggregate
+	for _, sample := range samples {
+		if excludeAnomaly(sample) {
+			continue
+		}
+
+		start := periodStart(sample.Time.Local(), period)
+		if len(aggregates) == 0 || !aggregates[len(aggregates)-1].Start.Equal(start) {
+			aggregates = append(aggregates, Aggregate{Type: measurementType, Period: period, Start: start, Stat: stat})
+		}
+
+		current := &aggregates[len(aggregates)-1]
+		current.Value += sample.Value
+		current.Count++
+	}
+
+	if stat == "avg" {
+		for i := range aggregates {
+			aggregates[i].Value /= float64(aggregates[i].Count)
+		}
+	}
+
+	return aggregates
+}
+
+// storeAggregates computes aggregates for every aggregated type of the named
+// account in the store, optionally restricted to one type and period.
+func storeAggregates(store *HistoryStore, user string, measurementType string, period string) []Aggregate {
+	aggregates := []Aggregate{}
+	for t, stat := range aggregateStats {
+		if measurementType != "" && t != measurementType {
+			continue
+		}
+
+		samples := store.Samples(user, t, time.Time{}, time.Now())
+		for _, p := range aggregatePeriods {
+			if period != "" && p != period {
+				continue
+			}
+			aggregates = append(aggregates, computeAggregates(t, samples, p, stat)...)
+		}
+	}
+
+	sort.SliceStable(aggregates, func(i, j int) bool {
+		if aggregates[i].Type != aggregates[j].Type {
+			return aggregates[i].Type < aggregates[j].Type
+		}
+		return aggregates[i].Period > aggregates[j].Period
+	})
+
+	return aggregates
+}
+
+// updateAggregateMetrics sets aggregateMetric to the aggregates of the
+// current week and month of the named account.
+func updateAggregateMetrics(store *HistoryStore, user string) {
+	now := time.Now()
+	deleteUserSeries(aggregateMetric, user)
+
+	for _, aggregate := range storeAggregates(store, user, "", "") {
+		if !aggregate.Start.Equal(periodStart(now, aggregate.Period)) {
+			continue
+		}
+		aggregateMetric.WithLabelValues(user, aggregate.Type, aggregate.Period, aggregate.Stat).Set(aggregate.Value)
+	}
+}
+
+// aggregatesHandler serves every weekly and monthly aggregate of one account
+// in the store as JSON: the one named by the user query parameter, or the
+// primary account. The type and period query parameters restrict the result.
+func aggregatesHandler(store *HistoryStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		user := query.Get("user")
+		if user == "" {
+			user = primaryUser
+		}
+		if !contains(configuredAccounts(), user) {
+			http.Error(w, fmt.Sprintf("unknown user %q", user), http.StatusNotFound)
+			return
+		}
+		aggregates := storeAggregates(store, user, query.Get("type"), query.Get("period"))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(aggregates)
+	})
+}
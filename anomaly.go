@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+)
+
+// flagAnomalies sets Anomalous on every sample of history, newest first,
+// that differs implausibly from the last plausible reading before it
+// according to the configured plausibility check, so a misread neither
+// lingers in the trends once it is no longer the latest nor gets the next
+// genuine reading flagged. withings_measurement_anomaly reflects the latest.
+func flagAnomalies(ctx context.Context, history []Sample) {
+	if len(history) == 0 {
+		return
+	}
+	latest := &history[0]
+	check, ok := config.Anomalies[latest.Type]
+	if !ok || check.MaxChange <= 0 {
+		return
+	}
+
+	var plausible *Sample
+	for i := len(history) - 1; i >= 0; i-- {
+		sample := &history[i]
+		sample.Anomalous = plausible != nil && math.Abs(sample.Value-plausible.Value) > check.MaxChange
+		if sample == latest && sample.Anomalous {
+			log.Printf("Latest %s measurement (%.1f) differs from the last plausible one (%.1f) by more than %.1f; flagging it as an anomaly.", latest.Type, latest.Value, plausible.Value, check.MaxChange)
+		}
+		if !sample.Anomalous {
+			plausible = sample
+		}
+	}
+
+	anomalyMetric.WithLabelValues(contextUser(ctx), latest.Type).Set(boolValue(latest.Anomalous))
+}
+
+// excludeAnomaly reports whether sample should be left out of aggregates and
+// trends.
+func excludeAnomaly(sample Sample) bool {
+	return sample.Anomalous && config.Anomalies[sample.Type].Exclude
+}
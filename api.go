@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Status returned in the JSON body when the Withings API rate limit is hit.
+const withingsStatusTooManyRequests = 601
+
+// Statuses returned in the JSON body when authentication failed, e.g.
+// because the access token is invalid.
+var withingsAuthFailedStatuses = map[int]bool{100: true, 101: true, 102: true, 200: true, 401: true}
+
+// withingsRequest POSTs to the Withings API, authenticating with accessToken
+// if it is non-empty, and returns the response body. Actions that need a
+// signature are signed with signer. Every call is accounted for in apiQuota
+// and traced. Successful responses are reused for --cache-ttl.
+func withingsRequest(ctx context.Context, url string, accessToken string) (body []byte, err error) {
+	// Only responses with user data are cached; token requests must reach
+	// the API.
+	cacheKey := userCacheKey(ctx, url)
+	if accessToken != "" {
+		if cached, ok := responseTTLCache.Get(cacheKey); ok {
+			return cached, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	action := req.URL.Query().Get("action")
+	endpoint := apiEndpoint(req.URL.Path, action)
+	ctx, span := tracer.Start(ctx, fmt.Sprintf("withings %s %s", req.URL.Path, action),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.path", req.URL.Path),
+			attribute.String("withings.action", action),
+		),
+	)
+	defer func() {
+		if err != nil {
+			atomic.AddInt64(&apiFailures, 1)
+			apiErrorsMetric.WithLabelValues(endpoint).Inc()
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	req = req.WithContext(ctx)
+
+	if signer != nil {
+		if err = signer.sign(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+
+	if accessToken != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	}
+
+	start := time.Now()
+	apiQuota.Record(start)
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		apiRequestsMetric.WithLabelValues(endpoint, "error").Inc()
+		return nil, err
+	}
+	defer res.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+
+	if remaining, err := strconv.Atoi(res.Header.Get("X-RateLimit-Remaining")); err == nil {
+		apiQuota.ReportRemaining(time.Now(), remaining)
+	}
+
+	body, err = ioutil.ReadAll(res.Body)
+	apiRequestDurationMetric.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		apiRequestsMetric.WithLabelValues(endpoint, "error").Inc()
+		return nil, err
+	}
+
+	var status struct {
+		Status int `json:"status"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		apiRequestsMetric.WithLabelValues(endpoint, "error").Inc()
+	} else {
+		apiRequestsMetric.WithLabelValues(endpoint, strconv.Itoa(status.Status)).Inc()
+	}
+	span.SetAttributes(attribute.Int("withings.status", status.Status))
+	if res.StatusCode == http.StatusTooManyRequests || status.Status == withingsStatusTooManyRequests {
+		apiQuota.RateLimited(time.Now())
+		return nil, fmt.Errorf("rate limited by the Withings API")
+	}
+	if accessToken != "" && (res.StatusCode == http.StatusUnauthorized || withingsAuthFailedStatuses[status.Status]) {
+		rejectAccessToken(ctx)
+		return nil, fmt.Errorf("access token rejected by the Withings API (status %d)", status.Status)
+	}
+
+	if accessToken != "" && status.Status == 0 {
+		responseTTLCache.Put(cacheKey, body)
+		lastSuccessfulFetchMetric.WithLabelValues(contextUser(ctx)).Set(float64(time.Now().Unix()))
+	}
+
+	return body, nil
+}
+
+// apiEndpoint returns the endpoint label of a request, e.g. v2/sleep/getsummary.
+func apiEndpoint(path string, action string) string {
+	endpoint := strings.Trim(path, "/")
+	if action != "" {
+		endpoint += "/" + action
+	}
+	return endpoint
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const appleHealthDateFormat = "2006-01-02 15:04:05 -0700"
+
+// The measurement type of each imported Apple Health record type.
+var appleHealthRecordTypes = map[string]string{
+	"HKQuantityTypeIdentifierBodyMass":          "weight",
+	"HKQuantityTypeIdentifierBodyFatPercentage": "fat_ratio",
+}
+
+// Records synced into Apple Health by Withings are skipped; they are already
+// available from the Withings API.
+var appleHealthWithingsSources = []string{"withings", "health mate"}
+
+// Readings from different sources this close together are taken to be the
+// same weigh-in.
+const appleHealthDuplicateWindow = 10 * time.Minute
+
+// readAppleHealthFile reads the weight and body fat records of an Apple
+// Health export, given either as the export.zip or the export.xml inside it.
+func readAppleHealthFile(name string) ([]Sample, error) {
+	if !strings.EqualFold(path.Ext(name), ".zip") {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return readAppleHealthXML(f)
+	}
+
+	archive, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	for _, file := range archive.File {
+		if path.Base(file.Name) != "export.xml" {
+			continue
+		}
+
+		f, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return readAppleHealthXML(f)
+	}
+
+	return nil, fmt.Errorf("no export.xml in %s", name)
+}
+
+func readAppleHealthXML(r io.Reader) ([]Sample, error) {
+	decoder := xml.NewDecoder(r)
+
+	var samples []Sample
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return samples, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		element, ok := token.(xml.StartElement)
+		if !ok || element.Name.Local != "Record" {
+			continue
+		}
+
+		var record struct {
+			Type       string `xml:"type,attr"`
+			SourceName string `xml:"sourceName,attr"`
+			Unit       string `xml:"unit,attr"`
+			Value      string `xml:"value,attr"`
+			StartDate  string `xml:"startDate,attr"`
+		}
+		if err := decoder.DecodeElement(&record, &element); err != nil {
+			return nil, err
+		}
+
+		measurementType, ok := appleHealthRecordTypes[record.Type]
+		if !ok || isWithingsSource(record.SourceName) {
+			continue
+		}
+
+		t, err := time.Parse(appleHealthDateFormat, record.StartDate)
+		if err != nil {
+			return nil, err
+		}
+		value, err := strconv.ParseFloat(record.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s record on %s: %v", record.Type, record.StartDate, err)
+		}
+
+		switch record.Unit {
+		case "lb":
+			value /= poundsPerKilogram
+		case "g":
+			value /= 1000
+		case "%":
+			// Apple Health stores percentages as fractions.
+			value *= 100
+		}
+
+		samples = append(samples, Sample{Type: measurementType, Time: t, Value: value})
+	}
+}
+
+func isWithingsSource(name string) bool {
+	name = strings.ToLower(name)
+	for _, source := range appleHealthWithingsSources {
+		if strings.Contains(name, source) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutDuplicates drops the samples that store already has a sample of the
+// same type for within appleHealthDuplicateWindow.
+func withoutDuplicates(store *HistoryStore, samples []Sample) []Sample {
+	var kept []Sample
+	for _, sample := range samples {
+		existing := store.Samples(sample.User, sample.Type, sample.Time.Add(-appleHealthDuplicateWindow), sample.Time.Add(appleHealthDuplicateWindow))
+		if len(existing) == 0 {
+			kept = append(kept, sample)
+		}
+	}
+	return kept
+}
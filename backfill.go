@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Number of samples sent per remote_write request during a backfill.
+const backfillBatchSize = 1000
+
+// backfill pushes every measurement of the account of ctx taken since from to
+// the remote_write endpoint in target, using the measurement timestamps.
+func backfill(ctx context.Context, tokens *tokenSource, target pushTarget, from time.Time) error {
+	for _, measurementType := range measurementTypes {
+		samples, err := getMeasurementHistory(ctx, withingsAPIBaseURL, tokens.Token(ctx), measurementType, from)
+		if err != nil {
+			return fmt.Errorf("cannot fetch %s measurements: %v", measurementType, err)
+		}
+		log.Printf("Backfilling %d %s measurements of %s...", len(samples), measurementType, contextUser(ctx))
+
+		// Convert like imperialGatherer does for the live gauges.
+		name, factor, imperial := measurementMetricNames[measurementType], 1.0, false
+		if imperialUnits {
+			name, factor, imperial = imperialMetricName(name)
+		}
+
+		// Samples come newest first, but remote_write needs them in order.
+		for end := len(samples); end > 0; end -= backfillBatchSize {
+			start := end - backfillBatchSize
+			if start < 0 {
+				start = 0
+			}
+
+			series := remoteWriteSeries{Labels: remoteWriteLabels(renamedMetric(name), map[string]string{"user": contextUser(ctx)})}
+			for i := end - 1; i >= start; i-- {
+				value := exposedValue(measurementType, samples[i].Value)
+				if imperial {
+					value = imperialValue(value, factor)
+				}
+				series.Samples = append(series.Samples, remoteWriteSample{Value: value, Timestamp: samples[i].Time})
+			}
+
+			if err := sendRemoteWrite(ctx, target, []remoteWriteSeries{series}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Measure types of a blood pressure reading.
+const (
+	diastolicMeasureType = 9
+	systolicMeasureType  = 10
+)
+
+var (
+	bloodPressurePolledMu sync.Mutex
+	// When the blood pressure readings of each user were last fetched.
+	bloodPressurePolled = map[string]time.Time{}
+)
+
+// updateBloodPressureMetrics exposes the latest blood pressure reading, e.g.
+// from a BPM Connect, taken from the newest measure group holding both the
+// systolic and the diastolic value. The first poll walks back from the
+// newest reading until it finds one; later polls only fetch the readings
+// updated since the previous poll.
+func updateBloodPressureMetrics(ctx context.Context, accessToken string) {
+	user := contextUser(ctx)
+	start := time.Now()
+	bloodPressurePolledMu.Lock()
+	polled := bloodPressurePolled[user]
+	bloodPressurePolledMu.Unlock()
+
+	var latestDate int64
+	var systolic, diastolic float64
+	var deviceID, source string
+
+	offset := 0
+	for {
+		url := fmt.Sprintf("%s/measure?action=getmeas&meastypes=%d,%d&category=%d", withingsAPIBaseURL, diastolicMeasureType, systolicMeasureType, measureCategoryReal)
+		if !polled.IsZero() {
+			url += fmt.Sprintf("&lastupdate=%d", polled.Unix())
+		}
+		if offset > 0 {
+			url += fmt.Sprintf("&offset=%d", offset)
+		}
+
+		body, err := withingsRequest(ctx, url, accessToken)
+		if err != nil {
+			log.Printf("Cannot fetch blood pressure measurements: %v", err)
+			return
+		}
+
+		parsedMeasures := Measures{}
+		if err := json.Unmarshal(body, &parsedMeasures); err != nil {
+			log.Printf("Cannot parse blood pressure measurements: %v", err)
+			return
+		}
+		if parsedMeasures.Status != 0 {
+			log.Printf("Cannot fetch blood pressure measurements: getmeas returned status %d", parsedMeasures.Status)
+			return
+		}
+
+		for _, group := range parsedMeasures.Body.MeasureGroups {
+			if group.Date <= latestDate {
+				continue
+			}
+			var groupSystolic, groupDiastolic float64
+			for _, measure := range group.Measures {
+				switch measure.Type {
+				case systolicMeasureType:
+					groupSystolic = measure.Value * math.Pow10(measure.Unit)
+				case diastolicMeasureType:
+					groupDiastolic = measure.Value * math.Pow10(measure.Unit)
+				}
+			}
+			if groupSystolic > 0 && groupDiastolic > 0 {
+				latestDate, systolic, diastolic = group.Date, groupSystolic, groupDiastolic
+				deviceID, source = group.DeviceID, measurementSourceName(group.Attrib)
+			}
+		}
+
+		// Groups come newest first, so on the first poll older pages cannot
+		// hold a later reading.
+		if (polled.IsZero() && latestDate > 0) || parsedMeasures.Body.More == 0 || parsedMeasures.Body.Offset <= offset {
+			break
+		}
+		offset = parsedMeasures.Body.Offset
+	}
+
+	bloodPressurePolledMu.Lock()
+	bloodPressurePolled[user] = start
+	bloodPressurePolledMu.Unlock()
+
+	if latestDate == 0 {
+		if polled.IsZero() {
+			log.Println("No blood pressure measurements returned.")
+		}
+		return
+	}
+
+	if setBloodPressure(ctx, time.Unix(latestDate, 0), systolic, diastolic) {
+		recordMeasurementOrigin(ctx, accessToken, "bp", deviceID, source)
+	}
+}
+
+// setBloodPressure sets the blood pressure metrics to a reading taken at t,
+// unless a later reading is known. Readings come from both the measure API
+// and the heart list, which e.g. a BPM Core only reports to. It reports
+// whether the metrics were set.
+func setBloodPressure(ctx context.Context, t time.Time, systolic float64, diastolic float64) bool {
+	lastMeasuredMu.Lock()
+	newer := lastMeasured[contextUser(ctx)]["bp"].After(t)
+	lastMeasuredMu.Unlock()
+	if newer {
+		return false
+	}
+
+	user := contextUser(ctx)
+	log.Printf("Setting blood pressure metrics to %.0f/%.0f mmHg.\n", systolic, diastolic)
+	bloodPressureSystolicMetric.WithLabelValues(user).Set(systolic)
+	bloodPressureDiastolicMetric.WithLabelValues(user).Set(diastolic)
+	recordMeasurementTime(ctx, "bp", t)
+	return true
+}
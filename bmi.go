@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+var heightMu sync.Mutex
+
+// accountHeights caches the height measured for each account, in metres, so
+// it is fetched from the API at most once. Accounts without a height map to 0.
+var accountHeights = map[string]float64{}
+
+// height returns the account's height in metres, falling back to the height
+// of the account in the configuration file, and then to the global one, if
+// the account has none.
+func height(ctx context.Context, accessToken string) float64 {
+	heightMu.Lock()
+	defer heightMu.Unlock()
+
+	user := contextUser(ctx)
+	accountHeight, fetched := accountHeights[user]
+	if !fetched {
+		samples, err := getLatestMeasurements(ctx, withingsAPIBaseURL, accessToken, "height")
+		if err != nil {
+			// Try again next time rather than giving up on BMI.
+			log.Printf("Cannot fetch height: %v", err)
+		} else {
+			if len(samples) > 0 {
+				accountHeight = samples[0].Value
+			}
+			accountHeights[user] = accountHeight
+		}
+	}
+	if accountHeight == 0 {
+		return configuredHeight(user)
+	}
+
+	return accountHeight
+}
+
+// configuredHeight returns the height of the named account in the
+// configuration file, or the global height.
+func configuredHeight(user string) float64 {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+
+	for _, a := range config.Accounts {
+		if a.Name == user && a.Height > 0 {
+			return a.Height
+		}
+	}
+	return config.Height
+}
+
+// updateBMI sets withings_bmi from weight (in kg), if a height is known.
+func updateBMI(ctx context.Context, accessToken string, weight float64) {
+	if weight == 0 {
+		return
+	}
+
+	h := height(ctx, accessToken)
+	if h == 0 {
+		log.Println("No height known; not computing BMI. Set `height` in the configuration file.")
+		return
+	}
+
+	updateMetric(ctx, "bmi", weight/(h*h))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Measurement types of body components, keyed by the component label of
+// withings_body_composition_percent.
+var bodyComponents = map[string]string{
+	"fat":    "fat_mass",
+	"muscle": "muscle_mass",
+	"bone":   "bone_mass",
+	"water":  "hydration",
+}
+
+var bodyCompositionMetrics = map[string]*prometheus.GaugeVec{
+	"fat_mass": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "withings_fat_mass_kg",
+		Help: "Shows the latest fat mass measurement",
+	}, []string{"user"}),
+	"fat_free_mass": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "withings_fat_free_mass_kg",
+		Help: "Shows the latest fat-free mass measurement",
+	}, []string{"user"}),
+	"muscle_mass": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "withings_muscle_mass_kg",
+		Help: "Shows the latest muscle mass measurement",
+	}, []string{"user"}),
+	"bone_mass": prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "withings_bone_mass_kg",
+		Help: "Shows the latest bone mass measurement",
+	}, []string{"user"}),
+}
+
+// updateBodyComposition sets withings_body_composition_percent to each body
+// component as a percentage of the latest weight.
+func updateBodyComposition(ctx context.Context) {
+	latestValuesMu.Lock()
+	defer latestValuesMu.Unlock()
+
+	user := contextUser(ctx)
+	values := latestValues[user]
+	weight := values["weight"]
+	for component, measurementType := range bodyComponents {
+		mass, ok := values[measurementType]
+		if weight <= 0 || !ok || mass <= 0 {
+			bodyCompositionMetric.DeleteLabelValues(user, component)
+			continue
+		}
+		bodyCompositionMetric.WithLabelValues(user, component).Set(mass / weight * 100)
+	}
+}
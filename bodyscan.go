@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Measure types of a Body Scan's water and segmental body composition.
+const (
+	extracellularWaterMeasureType = 168
+	intracellularWaterMeasureType = 169
+	segmentFatFreeMassMeasureType = 173
+	segmentFatMassMeasureType     = 174
+	segmentMuscleMassMeasureType  = 175
+)
+
+// Names of the body segments, by the position of a segmental measure, used
+// as the segment label. Others are labelled with their number.
+var bodySegments = map[int]string{
+	3:  "right_arm",
+	4:  "left_arm",
+	10: "left_leg",
+	11: "right_leg",
+	12: "torso",
+}
+
+func bodySegment(position int) string {
+	if name, ok := bodySegments[position]; ok {
+		return name
+	}
+	return strconv.Itoa(position)
+}
+
+// The gauge of each segmental measure type.
+var bodyScanSegmentMetrics = map[int]*prometheus.GaugeVec{
+	segmentFatFreeMassMeasureType: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "withings_segment_fat_free_mass_kg",
+		Help: "Shows the latest fat-free mass measurement of the body segment",
+	}, []string{"user", "segment"}),
+	segmentFatMassMeasureType: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "withings_segment_fat_mass_kg",
+		Help: "Shows the latest fat mass measurement of the body segment",
+	}, []string{"user", "segment"}),
+	segmentMuscleMassMeasureType: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "withings_segment_muscle_mass_kg",
+		Help: "Shows the latest muscle mass measurement of the body segment",
+	}, []string{"user", "segment"}),
+}
+
+// The gauge of each whole-body water measure type.
+var bodyScanWaterMetrics = map[int]*prometheus.GaugeVec{
+	extracellularWaterMeasureType: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "withings_extracellular_water_kg",
+		Help: "Shows the latest extracellular water measurement",
+	}, []string{"user"}),
+	intracellularWaterMeasureType: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "withings_intracellular_water_kg",
+		Help: "Shows the latest intracellular water measurement",
+	}, []string{"user"}),
+}
+
+// updateBodyScanMetrics exposes the latest water and segmental body
+// composition measures of a Body Scan.
+func updateBodyScanMetrics(ctx context.Context, accessToken string) {
+	type bodyScanMeasure struct {
+		measureType int
+		position    int
+	}
+	type bodyScanValue struct {
+		date  int64
+		value float64
+	}
+	latest := map[bodyScanMeasure]bodyScanValue{}
+
+	offset := 0
+	for {
+		url := fmt.Sprintf("%s/measure?action=getmeas&meastypes=%d,%d,%d,%d,%d&category=%d", withingsAPIBaseURL,
+			extracellularWaterMeasureType, intracellularWaterMeasureType, segmentFatFreeMassMeasureType, segmentFatMassMeasureType, segmentMuscleMassMeasureType, measureCategoryReal)
+		if offset > 0 {
+			url += fmt.Sprintf("&offset=%d", offset)
+		}
+
+		body, err := withingsRequest(ctx, url, accessToken)
+		if err != nil {
+			log.Printf("Cannot fetch Body Scan measurements: %v", err)
+			return
+		}
+
+		parsedMeasures := Measures{}
+		if err := json.Unmarshal(body, &parsedMeasures); err != nil {
+			log.Printf("Cannot parse Body Scan measurements: %v", err)
+			return
+		}
+
+		for _, group := range parsedMeasures.Body.MeasureGroups {
+			for _, measure := range group.Measures {
+				key := bodyScanMeasure{measure.Type, -1}
+				if measure.Position != nil {
+					key.position = *measure.Position
+				}
+				if existing, ok := latest[key]; ok && existing.date >= group.Date {
+					continue
+				}
+				latest[key] = bodyScanValue{group.Date, math.Round(measure.Value*math.Pow10(measure.Unit)*10) / 10}
+				recordMeasurementTime(ctx, "bodyscan", time.Unix(group.Date, 0))
+			}
+		}
+
+		if parsedMeasures.Body.More == 0 || parsedMeasures.Body.Offset <= offset {
+			break
+		}
+		offset = parsedMeasures.Body.Offset
+	}
+
+	user := contextUser(ctx)
+	for _, gauge := range bodyScanSegmentMetrics {
+		deleteUserSeries(gauge, user)
+	}
+	for key, measure := range latest {
+		if gauge, ok := bodyScanWaterMetrics[key.measureType]; ok {
+			gauge.WithLabelValues(user).Set(measure.value)
+			continue
+		}
+		if gauge, ok := bodyScanSegmentMetrics[key.measureType]; ok && key.position >= 0 {
+			gauge.WithLabelValues(user, bodySegment(key.position)).Set(measure.value)
+		}
+	}
+	log.Printf("Setting Body Scan metrics for %d measures.\n", len(latest))
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestBodySegment(t *testing.T) {
+	for position, want := range map[int]string{
+		3:  "right_arm",
+		4:  "left_arm",
+		10: "left_leg",
+		11: "right_leg",
+		12: "torso",
+		2:  "2",
+	} {
+		if got := bodySegment(position); got != want {
+			t.Errorf("bodySegment(%d) = %q, want %q", position, got, want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// responseCache keeps Withings API responses for past days on disk, so
+// restarts and backfills do not fetch the same history again. A nil cache
+// caches nothing.
+type responseCache struct {
+	dir string
+}
+
+// apiCache is the cache configured with --cache.dir, if any.
+var apiCache *responseCache
+
+// Get returns the cached response for key.
+func (c *responseCache) Get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, key))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// Put caches a response under key. Failures are logged; the response can
+// always be fetched again.
+func (c *responseCache) Put(key string, data []byte) {
+	if c == nil {
+		return
+	}
+
+	path := filepath.Join(c.dir, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Printf("Cannot cache API response: %v", err)
+		return
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Cannot cache API response: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("Cannot cache API response: %v", err)
+	}
+}
+
+// userCacheKey scopes key to the account ctx collects data of. The default
+// account keeps the unscoped keys of single-account setups.
+func userCacheKey(ctx context.Context, key string) string {
+	if user := contextUser(ctx); user != defaultUser {
+		return filepath.Join(user, key)
+	}
+	return key
+}
+
+// cacheable reports whether data up to end is final. Withings may still
+// process a night's data the following morning, so only days before
+// yesterday count.
+func cacheable(end time.Time) bool {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	return end.Before(today.AddDate(0, 0, -1))
+}
+
+// memoryCache keeps Withings API responses in memory for ttl, so frequent
+// refreshes don't each cost API quota. A nil cache caches nothing. It is safe
+// for concurrent use.
+type memoryCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]memoryCacheEntry
+}
+
+type memoryCacheEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// responseTTLCache is the cache configured with --cache-ttl, if any.
+var responseTTLCache *memoryCache
+
+func newMemoryCache(ttl time.Duration) *memoryCache {
+	return &memoryCache{ttl: ttl, entries: map[string]memoryCacheEntry{}}
+}
+
+// Get returns the response cached under key, unless it has expired.
+func (c *memoryCache) Get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.data, true
+}
+
+// Put caches a response under key for the cache's TTL, dropping expired
+// responses.
+func (c *memoryCache) Put(key string, data []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = memoryCacheEntry{data: data, expires: now.Add(c.ttl)}
+}
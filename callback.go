@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Port of the local server receiving the authorization redirect.
+var oauthCallbackPort = 8989
+
+// The redirect URI set with --oauth.redirect-uri, if any.
+var oauthRedirectURI string
+
+// Whether to request access to the demo user, with auth --demo.
+var oauthDemo bool
+
+// redirectURI returns the OAuth redirect URI, which has to match the
+// callback URL of the Withings API application.
+func redirectURI() string {
+	if oauthRedirectURI != "" {
+		return oauthRedirectURI
+	}
+	return fmt.Sprintf("http://localhost:%d/", oauthCallbackPort)
+}
+
+// redirectURIParam returns the redirect URI escaped for a query string.
+func redirectURIParam() string {
+	return url.QueryEscape(redirectURI())
+}
+
+// newOAuthState returns a random state for one authorization attempt, so
+// redirects that were not caused by it can be told apart.
+func newOAuthState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// waitForAuthorizationCode serves the OAuth redirect on the callback port
+// until it receives an authorization code for state, then shuts the server
+// down. Redirects with another state are rejected.
+func waitForAuthorizationCode(ctx context.Context, state string) (string, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", oauthCallbackPort))
+	if err != nil {
+		return "", err
+	}
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+			log.Printf("Rejecting an authorization redirect with the wrong state.")
+			http.Error(w, "Unexpected state", http.StatusBadRequest)
+			return
+		}
+
+		res := result{code: query.Get("code")}
+		if res.code == "" {
+			res.err = fmt.Errorf("authorization failed: %s", query.Get("error"))
+			http.Error(w, "Authorization failed; check the exporter's output.", http.StatusBadRequest)
+		} else {
+			fmt.Fprintln(w, "The exporter is now authorized; you can close this window.")
+		}
+
+		select {
+		case results <- res:
+		default:
+		}
+	})}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("OAuth callback server failed: %v", err)
+		}
+	}()
+	defer server.Shutdown(context.Background())
+
+	select {
+	case res := <-results:
+		return res.code, res.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
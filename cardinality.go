@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// maxLabelCombinations caps the number of series exposed per withings_
+// metric; 0 means no cap.
+var maxLabelCombinations = 0
+
+var (
+	cardinalityWarnedMu sync.Mutex
+	cardinalityWarned   = map[string]bool{}
+)
+
+const cardinalityMetricName = "withings_series_limit_reached"
+
+// cardinalityGuard drops series beyond maxLabelCombinations from each
+// labelled withings_ metric, and reports the state of every such metric in
+// withings_series_limit_reached.
+type cardinalityGuard struct {
+	prometheus.Gatherer
+}
+
+func (g cardinalityGuard) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	if maxLabelCombinations <= 0 {
+		return families, err
+	}
+
+	limited := &dto.MetricFamily{
+		Name: proto(cardinalityMetricName),
+		Help: proto("Whether series of the metric were dropped because it exceeded --metrics.max-label-combinations (1) or not (0)"),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, family := range families {
+		name := family.GetName()
+		if !strings.HasPrefix(name, "withings_") || len(family.Metric) == 0 || !hasDataLabels(family.Metric[0]) {
+			continue
+		}
+
+		reached := 0.0
+		if len(family.Metric) > maxLabelCombinations {
+			warnCardinality(name, len(family.Metric))
+			family.Metric = family.Metric[:maxLabelCombinations]
+			reached = 1
+		}
+		limited.Metric = append(limited.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{Name: proto("metric"), Value: proto(name)}},
+			Gauge: &dto.Gauge{Value: &reached},
+		})
+	}
+
+	// An empty family is invalid in the exposition formats.
+	if len(limited.Metric) == 0 {
+		return families, err
+	}
+	families = append(families, limited)
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].GetName() < families[j].GetName()
+	})
+
+	return families, err
+}
+
+// hasDataLabels reports whether metric has labels other than user, which
+// only multiplies series by the number of accounts.
+func hasDataLabels(metric *dto.Metric) bool {
+	for _, label := range metric.GetLabel() {
+		if label.GetName() != "user" {
+			return true
+		}
+	}
+	return false
+}
+
+// warnCardinality logs the first time a metric hits the cap.
+func warnCardinality(name string, series int) {
+	cardinalityWarnedMu.Lock()
+	defer cardinalityWarnedMu.Unlock()
+
+	if !cardinalityWarned[name] {
+		cardinalityWarned[name] = true
+		log.Printf("Metric %s has %d series, more than --metrics.max-label-combinations=%d; dropping the rest.", name, series, maxLabelCombinations)
+	}
+}
+
+func proto(s string) *string {
+	return &s
+}
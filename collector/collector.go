@@ -0,0 +1,286 @@
+// Package collector provides a Prometheus collector for Withings
+// measurements, for Go programs that want to register Withings metrics in
+// their own registry instead of running withings-exporter separately:
+//
+//	c := collector.New(collector.Config{
+//		ClientID:     os.Getenv("WITHINGS_API_CLIENT_ID"),
+//		ClientSecret: os.Getenv("WITHINGS_API_CLIENT_SECRET"),
+//		RefreshToken: os.Getenv("WITHINGS_API_REFRESH_TOKEN"),
+//	})
+//	prometheus.MustRegister(c)
+//
+// The metrics have the same names as those of withings-exporter.
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultBaseURL = "https://wbsapi.withings.net"
+
+// A measure type of the Withings measure API.
+type measureType struct {
+	id   int
+	desc *prometheus.Desc
+}
+
+// The measurement types the collector exposes, keyed by the type names used
+// by withings-exporter.
+var measureTypes = map[string]measureType{
+	"weight":              {1, prometheus.NewDesc("withings_current_weight", "Shows the latest weight measurement (in kg)", nil, nil)},
+	"fat_free_mass":       {5, prometheus.NewDesc("withings_fat_free_mass_kg", "Shows the latest fat-free mass measurement", nil, nil)},
+	"fat_ratio":           {6, prometheus.NewDesc("withings_fat_ratio_percent", "Shows the latest body fat percentage measurement", nil, nil)},
+	"fat_mass":            {8, prometheus.NewDesc("withings_fat_mass_kg", "Shows the latest fat mass measurement", nil, nil)},
+	"heart_rate":          {11, prometheus.NewDesc("withings_heart_rate_bpm", "Shows the latest heart pulse measurement, e.g. from a scale (in beats per minute)", nil, nil)},
+	"spo2":                {54, prometheus.NewDesc("withings_spo2_percent", "Shows the latest blood oxygen saturation (SpO2) measurement", nil, nil)},
+	"body_temperature":    {71, prometheus.NewDesc("withings_body_temperature_celsius", "Shows the latest body temperature measurement (in degrees celsius)", nil, nil)},
+	"skin_temperature":    {73, prometheus.NewDesc("withings_skin_temperature_celsius", "Shows the latest skin temperature measurement (in degrees celsius)", nil, nil)},
+	"muscle_mass":         {76, prometheus.NewDesc("withings_muscle_mass_kg", "Shows the latest muscle mass measurement", nil, nil)},
+	"hydration":           {77, prometheus.NewDesc("withings_current_hydration", "Shows the latest hydration measurement (in kg)", nil, nil)},
+	"bone_mass":           {88, prometheus.NewDesc("withings_bone_mass_kg", "Shows the latest bone mass measurement", nil, nil)},
+	"pulse_wave_velocity": {91, prometheus.NewDesc("withings_pulse_wave_velocity_meters_per_second", "Shows the latest pulse wave velocity measurement, e.g. from a Body Cardio scale", nil, nil)},
+	"vo2max":              {123, prometheus.NewDesc("withings_vo2max", "Shows the latest VO2max estimate (in ml/min/kg)", nil, nil)},
+	"vascular_age":        {155, prometheus.NewDesc("withings_vascular_age_years", "Shows the vascular age estimated from the latest pulse wave velocity measurement", nil, nil)},
+	"visceral_fat":        {170, prometheus.NewDesc("withings_visceral_fat", "Shows the latest visceral fat index measurement", nil, nil)},
+}
+
+var lastMeasuredDesc = prometheus.NewDesc(
+	"withings_last_measurement_timestamp_seconds",
+	"Time the latest measurement of the type was taken",
+	[]string{"type"}, nil,
+)
+
+// Config configures a Collector.
+type Config struct {
+	// OAuth credentials of a Withings developer application, and a refresh
+	// token obtained by authorizing it.
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+
+	// OnRefreshToken, if set, is called with every new refresh token the API
+	// issues, so it can be stored for the next start.
+	OnRefreshToken func(refreshToken string)
+
+	// Types restricts the exposed measurement types, e.g. weight and
+	// hydration; by default all are exposed.
+	Types []string
+
+	// Measurements are fetched at most once per RefreshInterval (default 30
+	// minutes); scrapes in between are served from memory.
+	RefreshInterval time.Duration
+
+	// HTTPClient is used for API requests; http.DefaultClient if nil.
+	HTTPClient *http.Client
+
+	// BaseURL of the Withings API, for testing.
+	BaseURL string
+}
+
+// Collector is a prometheus.Collector for Withings measurements.
+type Collector struct {
+	cfg Config
+
+	mu           sync.Mutex
+	accessToken  string
+	refreshToken string
+	expiry       time.Time
+	fetched      time.Time
+	values       map[string]measurement
+}
+
+type measurement struct {
+	value float64
+	time  time.Time
+}
+
+// New creates a Collector. It does not contact the API until the first
+// scrape.
+func New(cfg Config) *Collector {
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = defaultBaseURL
+	}
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = 30 * time.Minute
+	}
+	if len(cfg.Types) == 0 {
+		for name := range measureTypes {
+			cfg.Types = append(cfg.Types, name)
+		}
+	}
+
+	return &Collector{cfg: cfg, refreshToken: cfg.RefreshToken}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, name := range c.cfg.Types {
+		if t, ok := measureTypes[name]; ok {
+			ch <- t.desc
+		}
+	}
+	ch <- lastMeasuredDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.fetched) >= c.cfg.RefreshInterval {
+		values, err := c.fetch(context.Background())
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(lastMeasuredDesc, err)
+			return
+		}
+		c.values = values
+		c.fetched = time.Now()
+	}
+
+	for name, m := range c.values {
+		ch <- prometheus.MustNewConstMetric(measureTypes[name].desc, prometheus.GaugeValue, m.value)
+		ch <- prometheus.MustNewConstMetric(lastMeasuredDesc, prometheus.GaugeValue, float64(m.time.Unix()), name)
+	}
+}
+
+// fetch returns the latest value of each configured measurement type.
+func (c *Collector) fetch(ctx context.Context) (map[string]measurement, error) {
+	if err := c.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	byID := map[int]string{}
+	var ids []string
+	for _, name := range c.cfg.Types {
+		t, ok := measureTypes[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown measurement type %q", name)
+		}
+		byID[t.id] = name
+		ids = append(ids, fmt.Sprint(t.id))
+	}
+
+	var response struct {
+		Status int `json:"status"`
+		Body   struct {
+			MeasureGroups []struct {
+				Date     int64 `json:"date"`
+				Measures []struct {
+					Value float64 `json:"value"`
+					Type  int     `json:"type"`
+					Unit  int     `json:"unit"`
+				} `json:"measures"`
+			} `json:"measuregrps"`
+		} `json:"body"`
+	}
+	query := url.Values{
+		"action":    {"getmeas"},
+		"meastypes": {strings.Join(ids, ",")},
+		"category":  {"1"},
+	}
+	if err := c.request(ctx, "/measure", query, c.accessToken, &response); err != nil {
+		return nil, err
+	}
+	if response.Status != 0 {
+		return nil, fmt.Errorf("getmeas returned status %d", response.Status)
+	}
+
+	values := map[string]measurement{}
+	for _, group := range response.Body.MeasureGroups {
+		t := time.Unix(group.Date, 0)
+		for _, measure := range group.Measures {
+			name, ok := byID[measure.Type]
+			if !ok {
+				continue
+			}
+			if existing, ok := values[name]; ok && !t.After(existing.time) {
+				continue
+			}
+			values[name] = measurement{value: measure.Value * math.Pow10(measure.Unit), time: t}
+		}
+	}
+
+	return values, nil
+}
+
+// refresh obtains a new access token if the current one has expired.
+func (c *Collector) refresh(ctx context.Context) error {
+	if c.accessToken != "" && time.Now().Before(c.expiry) {
+		return nil
+	}
+
+	var response struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+		Body   struct {
+			AccessToken  string `json:"access_token"`
+			RefreshToken string `json:"refresh_token"`
+			ExpiresIn    int64  `json:"expires_in"`
+		} `json:"body"`
+	}
+	query := url.Values{
+		"action":        {"requesttoken"},
+		"grant_type":    {"refresh_token"},
+		"client_id":     {c.cfg.ClientID},
+		"client_secret": {c.cfg.ClientSecret},
+		"refresh_token": {c.refreshToken},
+	}
+	if err := c.request(ctx, "/v2/oauth2", query, "", &response); err != nil {
+		return err
+	}
+	if response.Status != 0 {
+		return fmt.Errorf("refreshing token: status %d: %s", response.Status, response.Error)
+	}
+
+	c.accessToken = response.Body.AccessToken
+	c.expiry = time.Now().Add(time.Duration(response.Body.ExpiresIn) * time.Second)
+	if response.Body.RefreshToken != "" && response.Body.RefreshToken != c.refreshToken {
+		c.refreshToken = response.Body.RefreshToken
+		if c.cfg.OnRefreshToken != nil {
+			c.cfg.OnRefreshToken(c.refreshToken)
+		}
+	}
+
+	return nil
+}
+
+func (c *Collector) request(ctx context.Context, path string, query url.Values, accessToken string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.cfg.BaseURL+path, strings.NewReader(query.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	res, err := c.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, res.Status)
+	}
+
+	return json.Unmarshal(body, result)
+}
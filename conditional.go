@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// scrapeVersion is the version of the measurement data of one scrape
+// selection, as reported in ETag and Last-Modified headers.
+type scrapeVersion struct {
+	etag     string
+	modified time.Time
+}
+
+var (
+	scrapeVersionsMu sync.Mutex
+	scrapeVersions   = map[string]scrapeVersion{}
+)
+
+// currentScrapeVersion hashes the measurement series of the given
+// collectors. Exporter series such as the Go runtime metrics change on every
+// scrape, so they do not count as modifications.
+func currentScrapeVersion(names []string) (scrapeVersion, error) {
+	var data []string
+	for _, name := range names {
+		if name != exporterCollector {
+			data = append(data, name)
+		}
+	}
+
+	families, err := collectorGatherer{prometheus.DefaultGatherer, data}.Gather()
+	if err != nil {
+		return scrapeVersion{}, err
+	}
+
+	hash := sha256.New()
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(hash, family); err != nil {
+			return scrapeVersion{}, err
+		}
+	}
+	etag := fmt.Sprintf(`"%x"`, hash.Sum(nil)[:16])
+
+	key := strings.Join(names, ",")
+	scrapeVersionsMu.Lock()
+	defer scrapeVersionsMu.Unlock()
+
+	version, ok := scrapeVersions[key]
+	if !ok || version.etag != etag {
+		version = scrapeVersion{etag: etag, modified: time.Now().UTC().Truncate(time.Second)}
+		scrapeVersions[key] = version
+	}
+
+	return version, nil
+}
+
+// notModified sets the ETag and Last-Modified headers for version and
+// reports whether the request's conditional headers show that the scraper
+// already has it.
+func notModified(w http.ResponseWriter, r *http.Request, version scrapeVersion) bool {
+	w.Header().Set("ETag", version.etag)
+	w.Header().Set("Last-Modified", version.modified.Format(http.TimeFormat))
+
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, etag := range strings.Split(match, ",") {
+			etag = strings.TrimSpace(etag)
+			if etag == version.etag || etag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		return !version.modified.After(since)
+	}
+
+	return false
+}
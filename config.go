@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the optional YAML configuration file passed with --config.file.
+type Config struct {
+	// Height in metres, used to compute BMI when the account has no height
+	// measurement.
+	Height float64 `yaml:"height"`
+
+	// Plausibility checks keyed by measurement type, e.g. weight.
+	Anomalies map[string]AnomalyConfig `yaml:"anomalies"`
+
+	Sleep SleepConfig `yaml:"sleep"`
+
+	// Window of weight history withings_weight_change_rate_kg_per_week is
+	// computed over (default 4 weeks).
+	WeightTrendWindow time.Duration `yaml:"weight_trend_window"`
+
+	// Unit to expose temperatures in: celsius (the default) or fahrenheit.
+	TemperatureUnit string `yaml:"temperature_unit"`
+
+	// Additional gauges computed from the latest values, exposed as
+	// withings_<name>.
+	DerivedMetrics []DerivedMetricConfig `yaml:"derived_metrics"`
+
+	// Withings accounts to collect metrics for, each exposed with its name
+	// as the user label. Without accounts, the exporter collects those of
+	// the account authorized with the command line credentials, as user
+	// "default".
+	Accounts []AccountConfig `yaml:"accounts"`
+
+	// Additional Withings measure types to export, keyed by measure type
+	// ID.
+	MeasureTypes map[int]MeasureTypeConfig `yaml:"measure_types"`
+
+	// Overrides of metric names and help texts, keyed by the original
+	// metric name.
+	Metrics map[string]MetricOverride `yaml:"metrics"`
+}
+
+// DerivedMetricConfig defines a gauge computed from other values, e.g.
+// `weight * (1 - fat_ratio / 100)`. Expressions may use +, -, *, /,
+// parentheses, numbers and the names of fetched values.
+type DerivedMetricConfig struct {
+	Name       string `yaml:"name"`
+	Expression string `yaml:"expression"`
+	Help       string `yaml:"help"`
+}
+
+// AccountConfig configures one Withings account.
+type AccountConfig struct {
+	Name string `yaml:"name"`
+	// Refresh token to start from if the token file holds no valid tokens.
+	RefreshToken string `yaml:"refresh_token"`
+	// Token file of the account (default: --token-file with the name
+	// appended, e.g. token-alice.json).
+	TokenFile string `yaml:"token_file"`
+	// Height in metres, used to compute BMI when the account has no height
+	// (default: height).
+	Height float64 `yaml:"height"`
+}
+
+// SleepConfig controls how sleep sessions are classified.
+type SleepConfig struct {
+	// Sessions no longer than this that start during the day are naps
+	// (default 4h).
+	NapMaxDuration time.Duration `yaml:"nap_max_duration"`
+	// Hours (0-23, local to the session) between which the day starts and
+	// ends for nap detection (default 8 and 20).
+	DayStartHour *int `yaml:"day_start_hour"`
+	DayEndHour   *int `yaml:"day_end_hour"`
+}
+
+// AnomalyConfig flags readings that differ implausibly from the previous one.
+type AnomalyConfig struct {
+	// Largest plausible change between consecutive readings, in the unit of
+	// the measurement (e.g. kg).
+	MaxChange float64 `yaml:"max_change"`
+	// Exclude flagged readings from aggregates and trends.
+	Exclude bool `yaml:"exclude"`
+}
+
+// config is the loaded configuration; it is empty if no file was given.
+var config = &Config{}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, err
+	}
+	if err := validateMetricOverrides(c.Metrics); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
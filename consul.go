@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// consulService is the payload of Consul's /v1/agent/service/register.
+// https://developer.hashicorp.com/consul/api-docs/agent/service#register-service
+type consulService struct {
+	ID      string             `json:"ID"`
+	Name    string             `json:"Name"`
+	Address string             `json:"Address,omitempty"`
+	Port    int                `json:"Port"`
+	Tags    []string           `json:"Tags,omitempty"`
+	Check   consulServiceCheck `json:"Check"`
+}
+
+type consulServiceCheck struct {
+	HTTP                           string `json:"HTTP"`
+	Interval                       string `json:"Interval"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+// registerWithConsul registers the exporter with the Consul agent at
+// consulAddress, with an HTTP health check against /-/healthy. Consul removes
+// the service by itself once the check has been failing for a while.
+func registerWithConsul(consulAddress string, token string, name string, address string, port int, tags []string) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	checkHost := address
+	if checkHost == "" {
+		checkHost = "localhost"
+	}
+
+	service := consulService{
+		ID:      fmt.Sprintf("%s-%s-%d", name, hostname, port),
+		Name:    name,
+		Address: address,
+		Port:    port,
+		Tags:    tags,
+		Check: consulServiceCheck{
+			HTTP:                           fmt.Sprintf("http://%s:%d/-/healthy", checkHost, port),
+			Interval:                       "30s",
+			DeregisterCriticalServiceAfter: "10m",
+		},
+	}
+
+	body, err := json.Marshal(service)
+	if err != nil {
+		return err
+	}
+
+	// CONSUL_HTTP_ADDR is commonly given without a scheme.
+	if !strings.Contains(consulAddress, "://") {
+		consulAddress = "http://" + consulAddress
+	}
+
+	req, err := http.NewRequest("PUT", strings.TrimSuffix(consulAddress, "/")+"/v1/agent/service/register", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul returned %s", res.Status)
+	}
+
+	return nil
+}
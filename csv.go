@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The exporter's own CSV format: one sample per row.
+var historyCSVHeader = []string{"type", "time", "value", "intraday", "user"}
+
+// Columns in the weight.csv file of a Withings data export, keyed by the
+// column name prefix. Units are given in parentheses after the prefix.
+var withingsCSVColumns = map[string]string{
+	"weight":      "weight",
+	"fat mass":    "fat_mass",
+	"bone mass":   "bone_mass",
+	"muscle mass": "muscle_mass",
+	"hydration":   "hydration",
+}
+
+const withingsCSVDateFormat = "2006-01-02 15:04:05"
+
+const poundsPerKilogram = 2.20462262185
+
+// readCSV parses either a Withings export CSV or the exporter's own format,
+// based on the header row.
+func readCSV(r io.Reader) ([]Sample, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+
+	if len(header) >= 3 && header[0] == "type" && header[1] == "time" && header[2] == "value" {
+		return readHistoryCSV(reader)
+	}
+	if len(header) > 0 && header[0] == "date" {
+		return readWithingsCSV(reader, header)
+	}
+
+	return nil, fmt.Errorf("unrecognised CSV header %q", strings.Join(header, ","))
+}
+
+func readHistoryCSV(reader *csv.Reader) ([]Sample, error) {
+	var samples []Sample
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return samples, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) < 3 {
+			return nil, fmt.Errorf("line %d: expected type, time and value, got %d fields", line, len(record))
+		}
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		intraday := len(record) > 3 && record[3] == "true"
+		// Exports from before there were several accounts have no user.
+		user := ""
+		if len(record) > 4 {
+			user = strings.TrimSpace(record[4])
+		}
+
+		samples = append(samples, Sample{User: user, Type: record[0], Time: t, Value: value, Intraday: intraday})
+	}
+}
+
+func readWithingsCSV(reader *csv.Reader, header []string) ([]Sample, error) {
+	types := make([]string, len(header))
+	pounds := make([]bool, len(header))
+	for i, column := range header {
+		name := strings.TrimSpace(strings.SplitN(column, "(", 2)[0])
+		types[i] = withingsCSVColumns[name]
+		pounds[i] = strings.Contains(column, "(lb)")
+	}
+
+	var samples []Sample
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return samples, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		t, err := time.ParseInLocation(withingsCSVDateFormat, record[0], time.Local)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, field := range record {
+			if i >= len(types) || types[i] == "" || field == "" {
+				continue
+			}
+
+			value, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s column on %s: %v", header[i], record[0], err)
+			}
+			if pounds[i] {
+				value /= poundsPerKilogram
+			}
+
+			samples = append(samples, Sample{Type: types[i], Time: t, Value: value})
+		}
+	}
+}
+
+// writeHistoryCSV writes samples in the exporter's own CSV format.
+func writeHistoryCSV(w io.Writer, samples []Sample) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(historyCSVHeader); err != nil {
+		return err
+	}
+
+	for _, sample := range samples {
+		err := writer.Write([]string{
+			sample.Type,
+			sample.Time.Format(time.RFC3339),
+			strconv.FormatFloat(sample.Value, 'f', -1, 64),
+			strconv.FormatBool(sample.Intraday),
+			sample.User,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	lastMeasuredMu sync.Mutex
+	// Keyed by user, then by measurement type.
+	lastMeasured = map[string]map[string]time.Time{}
+)
+
+// recordMeasurementTime notes when a measurement of the given type was last
+// taken.
+func recordMeasurementTime(ctx context.Context, measurementType string, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+
+	lastMeasuredMu.Lock()
+	defer lastMeasuredMu.Unlock()
+
+	user := contextUser(ctx)
+	if lastMeasured[user] == nil {
+		lastMeasured[user] = map[string]time.Time{}
+	}
+	if t.After(lastMeasured[user][measurementType]) {
+		lastMeasured[user][measurementType] = t
+	}
+}
+
+var daysSinceDesc = prometheus.NewDesc(
+	"withings_days_since_last_measurement",
+	"Days since the most recent measurement of the type was taken",
+	[]string{"user", "type"}, nil,
+)
+
+var lastMeasuredDesc = prometheus.NewDesc(
+	"withings_last_measurement_timestamp_seconds",
+	"Time the most recent measurement of the type was taken",
+	[]string{"user", "type"}, nil,
+)
+
+var staleDesc = prometheus.NewDesc(
+	"withings_measurement_stale",
+	"Whether the most recent measurement of the type is older than --max-measurement-age (1) or not (0)",
+	[]string{"user", "type"}, nil,
+)
+
+// daysSinceCollector exposes withings_days_since_last_measurement, computed
+// at scrape time so it keeps growing between polls, and the time of the
+// measurement itself. With --max-measurement-age it also exposes whether
+// the measurement is stale.
+type daysSinceCollector struct{}
+
+func (daysSinceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- daysSinceDesc
+	ch <- lastMeasuredDesc
+	if maxMeasurementAge > 0 {
+		ch <- staleDesc
+	}
+}
+
+func (daysSinceCollector) Collect(ch chan<- prometheus.Metric) {
+	lastMeasuredMu.Lock()
+	defer lastMeasuredMu.Unlock()
+
+	now := time.Now()
+	for user, times := range lastMeasured {
+		for measurementType, t := range times {
+			ch <- prometheus.MustNewConstMetric(daysSinceDesc, prometheus.GaugeValue, now.Sub(t).Hours()/24, user, measurementType)
+			ch <- prometheus.MustNewConstMetric(lastMeasuredDesc, prometheus.GaugeValue, float64(t.Unix()), user, measurementType)
+			if maxMeasurementAge > 0 {
+				ch <- prometheus.MustNewConstMetric(staleDesc, prometheus.GaugeValue, boolValue(now.Sub(t) > maxMeasurementAge), user, measurementType)
+			}
+		}
+	}
+}
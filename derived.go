@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// derivedMetric is a gauge computed from the latest fetched values.
+type derivedMetric struct {
+	name  string
+	expr  expr
+	gauge *prometheus.GaugeVec
+}
+
+var derivedMetrics []derivedMetric
+
+var latestValuesMu sync.Mutex
+
+// latestValues holds the most recent value of every measurement and computed
+// metric, keyed by user and then by type, for use in derived metric
+// expressions.
+var latestValues = map[string]map[string]float64{}
+
+// newDerivedMetrics parses the derived metrics in the configuration file.
+// Clashes with other metrics are detected when registering them.
+func newDerivedMetrics(configs []DerivedMetricConfig) ([]derivedMetric, error) {
+	var metrics []derivedMetric
+	names := map[string]bool{}
+	for _, c := range configs {
+		if !metricNamePattern.MatchString(c.Name) {
+			return nil, fmt.Errorf("invalid derived metric name %q", c.Name)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("derived metric %s is defined more than once", c.Name)
+		}
+		names[c.Name] = true
+
+		e, err := parseExpr(c.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("derived metric %s: %v", c.Name, err)
+		}
+
+		help := c.Help
+		if help == "" {
+			help = fmt.Sprintf("Derived from %s", c.Expression)
+		}
+
+		metrics = append(metrics, derivedMetric{
+			name: c.Name,
+			expr: e,
+			gauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: "withings_" + c.Name,
+				Help: help,
+			}, []string{"user"}),
+		})
+	}
+
+	return metrics, nil
+}
+
+// setLatestValue records the latest value of a measurement or computed
+// metric.
+func setLatestValue(ctx context.Context, name string, value float64) {
+	latestValuesMu.Lock()
+	defer latestValuesMu.Unlock()
+
+	user := contextUser(ctx)
+	if latestValues[user] == nil {
+		latestValues[user] = map[string]float64{}
+	}
+	latestValues[user][name] = value
+}
+
+// updateDerivedMetrics recomputes every derived metric from the latest
+// values. Metrics whose inputs have not all been fetched yet are left alone.
+func updateDerivedMetrics(ctx context.Context) {
+	latestValuesMu.Lock()
+	defer latestValuesMu.Unlock()
+
+	user := contextUser(ctx)
+	for _, metric := range derivedMetrics {
+		value, err := metric.expr.eval(latestValues[user])
+		if err != nil {
+			log.Printf("Cannot compute withings_%s: %v", metric.name, err)
+			continue
+		}
+
+		log.Printf("Setting withings_%s metric to %.2f.\n", metric.name, value)
+		metric.gauge.WithLabelValues(user).Set(value)
+	}
+}
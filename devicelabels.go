@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// deviceLabels adds device and source labels to measurement metrics, set
+// with --metrics.device-labels.
+var deviceLabels = false
+
+// Attributions of measure groups entered by hand rather than taken by a
+// device.
+var manualAttribs = map[int]bool{2: true, 4: true}
+
+// measurementSourceName returns the source label of a measure group with the
+// given attribution.
+func measurementSourceName(attrib int) string {
+	if manualAttribs[attrib] {
+		return "manual"
+	}
+	return "device"
+}
+
+// How often getdevice is called at most to resolve unknown device IDs, e.g.
+// of devices that are no longer linked.
+const deviceModelsRefresh = time.Hour
+
+type measurementOrigin struct {
+	device string
+	source string
+}
+
+var (
+	measurementOriginsMu sync.Mutex
+	// The origin of the latest measurement of each type, by user.
+	measurementOrigins = map[string]map[string]measurementOrigin{}
+	// The model names of device IDs, and when they were last fetched, by
+	// user.
+	deviceModels          = map[string]map[string]string{}
+	deviceModelsFetchedAt = map[string]time.Time{}
+)
+
+// recordDeviceModels remembers the model names of the devices linked to the
+// account ctx collects data of.
+func recordDeviceModels(ctx context.Context, devices *Devices) {
+	measurementOriginsMu.Lock()
+	defer measurementOriginsMu.Unlock()
+
+	user := contextUser(ctx)
+	if deviceModels[user] == nil {
+		deviceModels[user] = map[string]string{}
+	}
+	for _, device := range devices.Body.Devices {
+		deviceModels[user][device.DeviceID] = device.Model
+	}
+	deviceModelsFetchedAt[user] = time.Now()
+}
+
+// recordMeasurementOrigin records the device and source of the latest
+// measurement of a type, resolving the device ID to its model name. Manual
+// measurements have no device.
+func recordMeasurementOrigin(ctx context.Context, accessToken string, measurementType string, deviceID string, source string) {
+	if !deviceLabels || source == "" {
+		return
+	}
+
+	user := contextUser(ctx)
+	measurementOriginsMu.Lock()
+	_, known := deviceModels[user][deviceID]
+	stale := time.Since(deviceModelsFetchedAt[user]) > deviceModelsRefresh
+	measurementOriginsMu.Unlock()
+	if deviceID != "" && !known && stale && accessToken != "" {
+		if devices, err := getDevices(ctx, accessToken); err != nil {
+			log.Printf("Cannot fetch devices: %v", err)
+		} else {
+			recordDeviceModels(ctx, devices)
+		}
+	}
+
+	measurementOriginsMu.Lock()
+	defer measurementOriginsMu.Unlock()
+
+	device := deviceID
+	if model, ok := deviceModels[user][deviceID]; ok {
+		device = model
+	}
+	if measurementOrigins[user] == nil {
+		measurementOrigins[user] = map[string]measurementOrigin{}
+	}
+	measurementOrigins[user][measurementType] = measurementOrigin{device: device, source: source}
+}
+
+// deviceLabelGatherer adds device and source labels to the series of
+// measurement metrics whose latest measurement's origin is known.
+type deviceLabelGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g deviceLabelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+
+	measurementOriginsMu.Lock()
+	defer measurementOriginsMu.Unlock()
+
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			user, key, ok := seriesMeasurementKey(family.GetName(), metric)
+			if !ok || labelValue(metric, "device") != "" || labelValue(metric, "source") != "" {
+				continue
+			}
+			origin, ok := measurementOrigins[user][key]
+			if !ok {
+				continue
+			}
+
+			metric.Label = append(metric.Label,
+				&dto.LabelPair{Name: proto("device"), Value: proto(origin.device)},
+				&dto.LabelPair{Name: proto("source"), Value: proto(origin.source)},
+			)
+			sort.Slice(metric.Label, func(i, j int) bool {
+				return metric.Label[i].GetName() < metric.Label[j].GetName()
+			})
+		}
+	}
+
+	return families, err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Battery levels reported by getdevice, as exposed by withings_device_battery.
+var batteryLevels = map[string]float64{
+	"low":    1,
+	"medium": 2,
+	"high":   3,
+}
+
+// getDevices returns the devices linked to the account.
+func getDevices(ctx context.Context, accessToken string) (*Devices, error) {
+	url := fmt.Sprintf("%s/v2/user?action=getdevice", withingsAPIBaseURL)
+	body, err := withingsRequest(ctx, url, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := &Devices{}
+	if err := json.Unmarshal(body, devices); err != nil {
+		return nil, err
+	}
+	if devices.Status != 0 {
+		return nil, fmt.Errorf("getdevice returned status %d", devices.Status)
+	}
+
+	return devices, nil
+}
+
+// updateDeviceMetrics sets withings_devices to the linked devices, and
+// exposes their battery level and last session.
+func updateDeviceMetrics(ctx context.Context, accessToken string) {
+	devices, err := getDevices(ctx, accessToken)
+	if err != nil {
+		log.Printf("Cannot fetch devices: %v", err)
+		return
+	}
+
+	recordDeviceModels(ctx, devices)
+
+	user := contextUser(ctx)
+	deleteUserSeries(devicesMetric, user)
+	deleteUserSeries(deviceBatteryMetric, user)
+	deleteUserSeries(deviceLastSessionMetric, user)
+	for _, device := range devices.Body.Devices {
+		devicesMetric.WithLabelValues(user, device.Model, device.Type).Set(1)
+		if level, ok := batteryLevels[device.Battery]; ok {
+			deviceBatteryMetric.WithLabelValues(user, device.Model, device.DeviceID).Set(level)
+		}
+		if device.LastSessionDate > 0 {
+			deviceLastSessionMetric.WithLabelValues(user, device.Model, device.DeviceID).Set(float64(device.LastSessionDate))
+		}
+	}
+	log.Printf("Setting withings_devices metric for %d devices.\n", len(devices.Body.Devices))
+}
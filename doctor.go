@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Largest clock difference with the Withings API that doctor accepts. Token
+// expiry and measurement times are compared against the local clock.
+const maxClockSkew = time.Minute
+
+// doctorReport collects the results of the doctor checks.
+type doctorReport struct {
+	failed bool
+}
+
+func (r *doctorReport) pass(check string, format string, args ...interface{}) {
+	fmt.Printf("[PASS] %s: %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (r *doctorReport) fail(check string, format string, args ...interface{}) {
+	r.failed = true
+	fmt.Printf("[FAIL] %s: %s\n", check, fmt.Sprintf(format, args...))
+}
+
+// runDoctor checks the exporter's configuration and its access to the
+// Withings API, printing a report. It returns false if any check failed.
+func runDoctor(ctx context.Context, clientID string, clientSecret string, refreshToken string, schedules map[string]string) bool {
+	report := &doctorReport{}
+
+	checkDoctorConfig(report, schedules)
+
+	if clientID == "" || clientSecret == "" {
+		report.fail("credentials", "--api-client-id and --api-client-secret are required")
+		return false
+	}
+	report.pass("credentials", "client ID and secret set")
+
+	if !checkDoctorReachability(ctx, report) {
+		return false
+	}
+
+	if refreshToken == "" {
+		report.fail("token", "no --api-refresh-token given; run `withings-exporter auth` to obtain one")
+		return false
+	}
+	accessToken, ok := checkDoctorToken(ctx, report, clientID, clientSecret, refreshToken)
+	if !ok {
+		return false
+	}
+
+	url := fmt.Sprintf("%s/measure?action=getmeas&meastypes=1&category=1&startdate=%d", withingsAPIBaseURL, time.Now().AddDate(0, 0, -1).Unix())
+	body, err := withingsRequest(ctx, url, accessToken)
+	var status struct {
+		Status int `json:"status"`
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &status)
+	}
+	switch {
+	case err != nil:
+		report.fail("measure API", "%v", err)
+	case status.Status != 0:
+		report.fail("measure API", "returned status %d", status.Status)
+	default:
+		report.pass("measure API", "measurements can be fetched")
+	}
+
+	remaining, limit := apiQuota.Remaining(time.Now()), apiQuota.Limit()
+	if remaining*10 < limit {
+		report.fail("rate limit", "only %d of %d requests left this minute", remaining, limit)
+	} else {
+		report.pass("rate limit", "%d of %d requests left this minute", remaining, limit)
+	}
+
+	return !report.failed
+}
+
+func checkDoctorConfig(report *doctorReport, schedules map[string]string) {
+	ok := true
+	for name, expr := range schedules {
+		if !contains(collectors, name) {
+			report.fail("configuration", "schedule for unknown collector %q", name)
+			ok = false
+			continue
+		}
+		if _, err := parseCronSchedule(expr); err != nil {
+			report.fail("configuration", "schedule for %s: %v", name, err)
+			ok = false
+		}
+	}
+	for name := range config.Anomalies {
+		if !contains(measurementTypes, name) {
+			report.fail("configuration", "anomaly check for unknown measurement type %q", name)
+			ok = false
+		}
+	}
+
+	if ok {
+		report.pass("configuration", "configuration file and flags are consistent")
+	}
+}
+
+// checkDoctorReachability checks that the API can be reached and that the
+// local clock agrees with it.
+func checkDoctorReachability(ctx context.Context, report *doctorReport) bool {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", withingsAPIBaseURL, nil)
+	if err != nil {
+		report.fail("API reachability", "%v", err)
+		return false
+	}
+
+	start := time.Now()
+	res, err := apiClient.Do(req)
+	if err != nil {
+		report.fail("API reachability", "%v", err)
+		return false
+	}
+	res.Body.Close()
+	report.pass("API reachability", "%s answered in %s", withingsAPIBaseURL, time.Since(start).Round(time.Millisecond))
+
+	serverTime, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		report.fail("clock skew", "API sent no usable Date header")
+		return true
+	}
+	// The Date header has a resolution of one second.
+	skew := start.Sub(serverTime).Round(time.Second)
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		report.fail("clock skew", "local clock is %s off from the API's", skew)
+	} else {
+		report.pass("clock skew", "local clock is within %s of the API's", maxClockSkew)
+	}
+
+	return true
+}
+
+// checkDoctorToken exchanges the refresh token and checks the granted
+// scopes, returning the access token.
+func checkDoctorToken(ctx context.Context, report *doctorReport, clientID string, clientSecret string, refreshToken string) (string, bool) {
+	url := fmt.Sprintf("%s/v2/oauth2?action=requesttoken&grant_type=refresh_token&client_id=%s&client_secret=%s&refresh_token=%s&redirect_uri=%s", withingsAPIBaseURL, clientID, clientSecret, refreshToken, redirectURIParam())
+	body, err := withingsRequest(ctx, url, "")
+	if err != nil {
+		report.fail("token", "%v", err)
+		return "", false
+	}
+
+	token := RequestToken{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		report.fail("token", "%v", err)
+		return "", false
+	}
+	if token.Status != 0 || token.Body.AccessToken == "" {
+		report.fail("token", "refresh token rejected with status %d: %s", token.Status, token.Error)
+		return "", false
+	}
+	report.pass("token", "refresh token is valid")
+
+	granted := strings.Split(token.Body.Scope, ",")
+	var missing []string
+	for _, scope := range strings.Split(scopes, ",") {
+		if !contains(granted, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) > 0 {
+		report.fail("scopes", "missing %s; authorize the exporter again", strings.Join(missing, ", "))
+	} else {
+		report.pass("scopes", "granted %s", token.Body.Scope)
+	}
+
+	return token.Body.AccessToken, true
+}
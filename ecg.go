@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ECGRecording is a single ECG with its raw signal, as written by export-ecg.
+type ECGRecording struct {
+	SignalID          int64     `json:"signalid"`
+	Time              time.Time `json:"time"`
+	DeviceID          string    `json:"deviceid"`
+	HeartRate         int       `json:"heart_rate"`
+	AFib              int       `json:"afib"`
+	SamplingFrequency int       `json:"sampling_frequency"`
+	WearPosition      int       `json:"wearposition"`
+	// Signal samples in micro-volts.
+	Signal []int `json:"signal"`
+}
+
+// getHeartList returns every entry from the heart list taken since the given
+// time (or ever, if it is zero).
+func getHeartList(ctx context.Context, accessToken string, since time.Time) (*HeartList, error) {
+	all := &HeartList{}
+	offset := 0
+	for {
+		url := fmt.Sprintf("%s/v2/heart?action=list", withingsAPIBaseURL)
+		if !since.IsZero() {
+			url += fmt.Sprintf("&startdate=%d", since.Unix())
+		}
+		if offset > 0 {
+			url += fmt.Sprintf("&offset=%d", offset)
+		}
+
+		body, err := withingsRequest(ctx, url, accessToken)
+		if err != nil {
+			return nil, err
+		}
+
+		page := HeartList{}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		if page.Status != 0 {
+			return nil, fmt.Errorf("heart list returned status %d", page.Status)
+		}
+
+		all.Body.Series = append(all.Body.Series, page.Body.Series...)
+		if !page.Body.More || page.Body.Offset <= offset {
+			return all, nil
+		}
+		offset = page.Body.Offset
+	}
+}
+
+func getHeartSignal(ctx context.Context, accessToken string, signalID int64) (*HeartSignal, error) {
+	url := fmt.Sprintf("%s/v2/heart?action=get&signalid=%d", withingsAPIBaseURL, signalID)
+	body, err := withingsRequest(ctx, url, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	signal := &HeartSignal{}
+	if err := json.Unmarshal(body, signal); err != nil {
+		return nil, err
+	}
+	if signal.Status != 0 {
+		return nil, fmt.Errorf("heart signal %d returned status %d", signalID, signal.Status)
+	}
+
+	return signal, nil
+}
+
+// exportECGs downloads every ECG recorded since the given time into dir, one
+// file per recording. Recordings that were exported before are skipped.
+func exportECGs(ctx context.Context, tokens *tokenSource, dir string, format string, since time.Time) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	list, err := getHeartList(ctx, tokens.Token(ctx), since)
+	if err != nil {
+		return err
+	}
+
+	exported := 0
+	for _, entry := range list.Body.Series {
+		if entry.ECG.SignalID == 0 {
+			continue
+		}
+
+		t := time.Unix(entry.Timestamp, 0)
+		path := filepath.Join(dir, fmt.Sprintf("ecg-%s-%d.%s", t.UTC().Format("20060102T150405Z"), entry.ECG.SignalID, format))
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+
+		signal, err := getHeartSignal(ctx, tokens.Token(ctx), entry.ECG.SignalID)
+		if err != nil {
+			return err
+		}
+
+		recording := ECGRecording{
+			SignalID:          entry.ECG.SignalID,
+			Time:              t,
+			DeviceID:          entry.DeviceID,
+			HeartRate:         entry.HeartRate,
+			AFib:              entry.ECG.AFib,
+			SamplingFrequency: signal.Body.SamplingFrequency,
+			WearPosition:      signal.Body.WearPosition,
+			Signal:            signal.Body.Signal,
+		}
+		if err := writeECG(path, format, recording); err != nil {
+			return err
+		}
+		exported++
+	}
+
+	log.Printf("Exported %d new ECG recordings to %s.", exported, dir)
+	return nil
+}
+
+func writeECG(path string, format string, recording ECGRecording) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(recording); err != nil {
+			return err
+		}
+	case "csv":
+		// One row per sample, with the time since the start of the recording.
+		writer := csv.NewWriter(f)
+		writer.Write([]string{"seconds", "microvolts"})
+		for i, value := range recording.Signal {
+			seconds := 0.0
+			if recording.SamplingFrequency > 0 {
+				seconds = float64(i) / float64(recording.SamplingFrequency)
+			}
+			writer.Write([]string{strconv.FormatFloat(seconds, 'f', -1, 64), strconv.Itoa(value)})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// faults are the failures currently simulated in fault-injection mode.
+type faults struct {
+	// Fail every API request with a transport error.
+	Error bool `json:"error"`
+	// Answer every API request with the rate limit status.
+	RateLimit bool `json:"rate_limit"`
+	// Answer every API request with the last response to the same action,
+	// so measurements stop changing.
+	Stale bool `json:"stale"`
+	// Leave these metrics out of /metrics.
+	MissingMetrics []string `json:"missing_metrics"`
+}
+
+// injectFaults is set with --testing.fault-injection.
+var injectFaults = false
+
+var (
+	injectedFaultsMu sync.Mutex
+	injectedFaults   faults
+)
+
+func currentFaults() faults {
+	injectedFaultsMu.Lock()
+	defer injectedFaultsMu.Unlock()
+	return injectedFaults
+}
+
+// faultsHandler shows (GET), replaces (POST) or clears (DELETE) the
+// injected faults.
+func faultsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		f := faults{}
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		injectedFaultsMu.Lock()
+		injectedFaults = f
+		injectedFaultsMu.Unlock()
+	case http.MethodDelete:
+		injectedFaultsMu.Lock()
+		injectedFaults = faults{}
+		injectedFaultsMu.Unlock()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentFaults())
+}
+
+// faultTransport applies the injected faults to API requests.
+type faultTransport struct {
+	next http.RoundTripper
+
+	mu   sync.Mutex
+	last map[string][]byte
+}
+
+func newFaultTransport(next http.RoundTripper) *faultTransport {
+	return &faultTransport{next: next, last: map[string][]byte{}}
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f := currentFaults()
+	key := req.URL.Path + "?" + req.URL.Query().Get("action")
+
+	switch {
+	case f.Error:
+		return nil, errors.New("injected fault")
+	case f.RateLimit:
+		return faultResponse(req, []byte(`{"status":601,"error":"injected rate limit"}`)), nil
+	case f.Stale:
+		t.mu.Lock()
+		body, ok := t.last[key]
+		t.mu.Unlock()
+		if ok {
+			return faultResponse(req, body), nil
+		}
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	t.mu.Lock()
+	t.last[key] = body
+	t.mu.Unlock()
+
+	return res, nil
+}
+
+func faultResponse(req *http.Request, body []byte) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// faultGatherer leaves the injected missing metrics out.
+type faultGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g faultGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+
+	missing := currentFaults().MissingMetrics
+	if len(missing) == 0 {
+		return families, err
+	}
+
+	var kept []*dto.MetricFamily
+	for _, family := range families {
+		if !contains(missing, family.GetName()) && !contains(missing, strings.TrimPrefix(family.GetName(), "withings_")) {
+			kept = append(kept, family)
+		}
+	}
+
+	return kept, err
+}
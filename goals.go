@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// getGoals returns the goals configured in the Withings app.
+func getGoals(ctx context.Context, accessToken string) (*Goals, error) {
+	url := fmt.Sprintf("%s/v2/user?action=getgoals", withingsAPIBaseURL)
+	body, err := withingsRequest(ctx, url, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	goals := &Goals{}
+	if err := json.Unmarshal(body, goals); err != nil {
+		return nil, err
+	}
+	if goals.Status != 0 {
+		return nil, fmt.Errorf("getgoals returned status %d", goals.Status)
+	}
+
+	return goals, nil
+}
+
+// updateGoalMetrics exposes the account's goals. They are also available to
+// derived metrics as goal_weight, goal_steps and goal_sleep.
+func updateGoalMetrics(ctx context.Context, accessToken string) {
+	goals, err := getGoals(ctx, accessToken)
+	if err != nil {
+		log.Printf("Cannot fetch goals: %v", err)
+		return
+	}
+
+	user := contextUser(ctx)
+	weight := goals.Body.Goals.Weight.Value * math.Pow10(goals.Body.Goals.Weight.Unit)
+	for _, goal := range []struct {
+		name  string
+		gauge *prometheus.GaugeVec
+		value float64
+	}{
+		{"goal_weight", goalWeightMetric, weight},
+		{"goal_steps", goalStepsMetric, goals.Body.Goals.Steps},
+		{"goal_sleep", goalSleepMetric, goals.Body.Goals.Sleep},
+	} {
+		if goal.value <= 0 {
+			goal.gauge.DeleteLabelValues(user)
+			continue
+		}
+		goal.gauge.WithLabelValues(user).Set(goal.value)
+		setLatestValue(ctx, goal.name, goal.value)
+	}
+	log.Printf("Setting goal metrics: weight %.1f kg, %.0f steps, %.0f s of sleep.\n", weight, goals.Body.Goals.Steps, goals.Body.Goals.Sleep)
+}
+
+// updateGoalProgress sets the progress gauges from the goals and the latest
+// weight and step count.
+func updateGoalProgress(ctx context.Context) {
+	latestValuesMu.Lock()
+	defer latestValuesMu.Unlock()
+
+	user := contextUser(ctx)
+	values := latestValues[user]
+	if goal, ok := values["goal_weight"]; ok && values["weight"] > 0 {
+		goalWeightRemainingMetric.WithLabelValues(user).Set(math.Round((values["weight"]-goal)*10) / 10)
+	}
+	if goal, ok := values["goal_steps"]; ok {
+		if steps, ok := values["steps"]; ok {
+			goalStepsProgressMetric.WithLabelValues(user).Set(steps / goal)
+		}
+	}
+}
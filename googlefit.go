@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	googleTokenURL    = "https://oauth2.googleapis.com/token"
+	googleFitAPIURL   = "https://www.googleapis.com/fitness/v1/users/me"
+	googleFitAppName  = "withings-exporter"
+	googleFitStreamID = "withings"
+)
+
+// googleFitDataType describes how a measurement type is stored in Google Fit.
+type googleFitDataType struct {
+	name   string
+	field  string
+	format string
+	// Whether a point covers the whole day starting at the sample's time,
+	// as for delta types that hold daily totals.
+	daily bool
+}
+
+// The Google Fit data type of each measurement type that has one.
+var googleFitDataTypes = map[string]googleFitDataType{
+	"weight":    {"com.google.weight", "weight", "floatPoint", false},
+	"fat_ratio": {"com.google.body.fat.percentage", "percentage", "floatPoint", false},
+	"steps":     {"com.google.step_count.delta", "steps", "integer", true},
+}
+
+// googleFitSink writes samples to Google Fit through its REST API, using a
+// refresh token of an OAuth client allowed the fitness.body.write and
+// fitness.activity.write scopes.
+type googleFitSink struct {
+	// The account whose samples go to the Google Fit account.
+	user         string
+	clientID     string
+	clientSecret string
+	refreshToken string
+
+	mu          sync.Mutex
+	accessToken string
+	expiry      time.Time
+	dataSources map[string]string
+}
+
+func newGoogleFitSink(user string, clientID string, clientSecret string, refreshToken string) *googleFitSink {
+	return &googleFitSink{
+		user:         user,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		refreshToken: refreshToken,
+		dataSources:  map[string]string{},
+	}
+}
+
+func (s *googleFitSink) Name() string {
+	return "Google Fit"
+}
+
+func (s *googleFitSink) Write(ctx context.Context, samples []Sample) error {
+	byType := map[string][]Sample{}
+	for _, sample := range samples {
+		if sample.User != s.user {
+			continue
+		}
+		if _, ok := googleFitDataTypes[sample.Type]; ok && !sample.Anomalous {
+			byType[sample.Type] = append(byType[sample.Type], sample)
+		}
+	}
+
+	if len(byType) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.refresh(ctx); err != nil {
+		return err
+	}
+
+	for measurementType, samples := range byType {
+		dataType := googleFitDataTypes[measurementType]
+		dataSourceID, err := s.dataSource(ctx, dataType)
+		if err != nil {
+			return err
+		}
+
+		if err := s.patchDataset(ctx, dataSourceID, dataType, samples); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// refresh obtains a new access token if the current one has expired.
+func (s *googleFitSink) refresh(ctx context.Context) error {
+	if s.accessToken != "" && time.Now().Before(s.expiry) {
+		return nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {s.clientID},
+		"client_secret": {s.clientSecret},
+		"refresh_token": {s.refreshToken},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", googleTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := googleRequest(req, &token); err != nil {
+		return fmt.Errorf("refreshing Google credentials: %v", err)
+	}
+
+	s.accessToken = token.AccessToken
+	// Refresh a minute early so requests never race the expiry.
+	s.expiry = tokenExpiryTime(time.Now(), token.ExpiresIn).Add(-time.Minute)
+	return nil
+}
+
+// dataSource returns the ID of the exporter's data source for dataType,
+// creating it on first use.
+func (s *googleFitSink) dataSource(ctx context.Context, dataType googleFitDataType) (string, error) {
+	if id, ok := s.dataSources[dataType.name]; ok {
+		return id, nil
+	}
+
+	var list struct {
+		DataSource []struct {
+			DataStreamID   string `json:"dataStreamId"`
+			DataStreamName string `json:"dataStreamName"`
+			Type           string `json:"type"`
+		} `json:"dataSource"`
+	}
+	req, err := s.newRequest(ctx, "GET", "/dataSources?dataTypeName="+url.QueryEscape(dataType.name), nil)
+	if err != nil {
+		return "", err
+	}
+	if err := googleRequest(req, &list); err != nil {
+		return "", fmt.Errorf("listing data sources: %v", err)
+	}
+	for _, source := range list.DataSource {
+		if source.Type == "raw" && source.DataStreamName == googleFitStreamID {
+			s.dataSources[dataType.name] = source.DataStreamID
+			return source.DataStreamID, nil
+		}
+	}
+
+	source := map[string]interface{}{
+		"dataStreamName": googleFitStreamID,
+		"type":           "raw",
+		"application":    map[string]string{"name": googleFitAppName},
+		"dataType": map[string]interface{}{
+			"name":  dataType.name,
+			"field": []map[string]string{{"name": dataType.field, "format": dataType.format}},
+		},
+	}
+	var created struct {
+		DataStreamID string `json:"dataStreamId"`
+	}
+	req, err = s.newRequest(ctx, "POST", "/dataSources", source)
+	if err != nil {
+		return "", err
+	}
+	if err := googleRequest(req, &created); err != nil {
+		return "", fmt.Errorf("creating %s data source: %v", dataType.name, err)
+	}
+
+	s.dataSources[dataType.name] = created.DataStreamID
+	return created.DataStreamID, nil
+}
+
+// patchDataset adds samples to a data source. Points at the same time
+// replace each other, so writing a sample twice is harmless.
+func (s *googleFitSink) patchDataset(ctx context.Context, dataSourceID string, dataType googleFitDataType, samples []Sample) error {
+	var points []map[string]interface{}
+	min, max := samples[0].Time, samples[0].Time
+	for _, sample := range samples {
+		value := map[string]interface{}{"fpVal": sample.Value}
+		if dataType.format == "integer" {
+			value = map[string]interface{}{"intVal": int64(sample.Value)}
+		}
+		end := sample.Time
+		if dataType.daily {
+			end = sample.Time.AddDate(0, 0, 1)
+		}
+		points = append(points, map[string]interface{}{
+			"dataTypeName":   dataType.name,
+			"startTimeNanos": sample.Time.UnixNano(),
+			"endTimeNanos":   end.UnixNano(),
+			"value":          []interface{}{value},
+		})
+
+		if sample.Time.Before(min) {
+			min = sample.Time
+		}
+		if end.After(max) {
+			max = end
+		}
+	}
+
+	dataset := map[string]interface{}{
+		"dataSourceId":   dataSourceID,
+		"minStartTimeNs": min.UnixNano(),
+		"maxEndTimeNs":   max.UnixNano(),
+		"point":          points,
+	}
+	path := fmt.Sprintf("/dataSources/%s/datasets/%d-%d", url.PathEscape(dataSourceID), min.UnixNano(), max.UnixNano())
+	req, err := s.newRequest(ctx, "PATCH", path, dataset)
+	if err != nil {
+		return err
+	}
+
+	if err := googleRequest(req, nil); err != nil {
+		return fmt.Errorf("writing %s points: %v", dataType.name, err)
+	}
+	return nil
+}
+
+func (s *googleFitSink) newRequest(ctx context.Context, method string, path string, body interface{}) (*http.Request, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, googleFitAPIURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.accessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return req, nil
+}
+
+// googleRequest sends req and decodes the JSON response into result, if it
+// is not nil.
+func googleRequest(req *http.Request, result interface{}) error {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(body, result)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+var sampleType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Sample",
+	Fields: graphql.Fields{
+		"user":      &graphql.Field{Type: graphql.String},
+		"type":      &graphql.Field{Type: graphql.String},
+		"time":      &graphql.Field{Type: graphql.DateTime},
+		"value":     &graphql.Field{Type: graphql.Float},
+		"intraday":  &graphql.Field{Type: graphql.Boolean},
+		"anomalous": &graphql.Field{Type: graphql.Boolean},
+	},
+})
+
+var aggregateType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Aggregate",
+	Fields: graphql.Fields{
+		"type":   &graphql.Field{Type: graphql.String},
+		"period": &graphql.Field{Type: graphql.String},
+		"start":  &graphql.Field{Type: graphql.DateTime},
+		"stat":   &graphql.Field{Type: graphql.String},
+		"value":  &graphql.Field{Type: graphql.Float},
+		"count":  &graphql.Field{Type: graphql.Int},
+	},
+})
+
+// graphQLUser returns the user argument of a query field, defaulting to the
+// primary account.
+func graphQLUser(p graphql.ResolveParams) (string, error) {
+	user, _ := p.Args["user"].(string)
+	if user == "" {
+		user = primaryUser
+	}
+	if !contains(configuredAccounts(), user) {
+		return "", fmt.Errorf("unknown user %q", user)
+	}
+	return user, nil
+}
+
+// newGraphQLSchema builds a read-only schema over the history store.
+func newGraphQLSchema(store *HistoryStore) (graphql.Schema, error) {
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"users": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "The configured accounts, the primary one first.",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return configuredAccounts(), nil
+				},
+			},
+			"measurementTypes": &graphql.Field{
+				Type:        graphql.NewList(graphql.String),
+				Description: "Measurement types with at least one stored sample.",
+				Args: graphql.FieldConfigArgument{
+					"user": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					user, err := graphQLUser(p)
+					if err != nil {
+						return nil, err
+					}
+					seen := map[string]bool{}
+					types := []string{}
+					for _, sample := range store.All() {
+						if sample.User == user && !seen[sample.Type] {
+							seen[sample.Type] = true
+							types = append(types, sample.Type)
+						}
+					}
+					sort.Strings(types)
+					return types, nil
+				},
+			},
+			"samples": &graphql.Field{
+				Type:        graphql.NewList(sampleType),
+				Description: "Stored samples of one type, oldest first.",
+				Args: graphql.FieldConfigArgument{
+					"user": &graphql.ArgumentConfig{Type: graphql.String},
+					"type": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"from": &graphql.ArgumentConfig{Type: graphql.DateTime},
+					"to":   &graphql.ArgumentConfig{Type: graphql.DateTime},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					user, err := graphQLUser(p)
+					if err != nil {
+						return nil, err
+					}
+					from, _ := p.Args["from"].(time.Time)
+					to, ok := p.Args["to"].(time.Time)
+					if !ok {
+						to = time.Now()
+					}
+					return store.Samples(user, p.Args["type"].(string), from, to), nil
+				},
+			},
+			"latest": &graphql.Field{
+				Type:        sampleType,
+				Description: "The most recent sample of one type.",
+				Args: graphql.FieldConfigArgument{
+					"user": &graphql.ArgumentConfig{Type: graphql.String},
+					"type": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					user, err := graphQLUser(p)
+					if err != nil {
+						return nil, err
+					}
+					sample, ok := store.Latest(user, p.Args["type"].(string))
+					if !ok {
+						return nil, nil
+					}
+					return sample, nil
+				},
+			},
+			"aggregates": &graphql.Field{
+				Type:        graphql.NewList(aggregateType),
+				Description: "Weekly and monthly aggregates, optionally restricted to one type and period.",
+				Args: graphql.FieldConfigArgument{
+					"user":   &graphql.ArgumentConfig{Type: graphql.String},
+					"type":   &graphql.ArgumentConfig{Type: graphql.String},
+					"period": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					user, err := graphQLUser(p)
+					if err != nil {
+						return nil, err
+					}
+					measurementType, _ := p.Args["type"].(string)
+					period, _ := p.Args["period"].(string)
+					return storeAggregates(store, user, measurementType, period), nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query})
+}
+
+// graphQLHandler serves GraphQL queries over the history store, sent either
+// as a POST body or in the query parameter of a GET request.
+func graphQLHandler(schema graphql.Schema) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Query         string                 `json:"query"`
+			OperationName string                 `json:"operationName"`
+			Variables     map[string]interface{} `json:"variables"`
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			request.Query = r.URL.Query().Get("query")
+		case http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		result := graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  request.Query,
+			OperationName:  request.OperationName,
+			VariableValues: request.Variables,
+			Context:        r.Context(),
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
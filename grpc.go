@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/issyl0/withings-exporter/withingspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// measurementsServer implements the gRPC Measurements service over the
+// history store.
+type measurementsServer struct {
+	withingspb.UnimplementedMeasurementsServer
+	store *HistoryStore
+}
+
+func (s *measurementsServer) ListUsers(ctx context.Context, req *withingspb.ListUsersRequest) (*withingspb.ListUsersResponse, error) {
+	names := configuredAccounts()
+	users := map[string]*withingspb.User{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		users[name] = &withingspb.User{Name: name}
+	}
+	for _, sample := range s.store.All() {
+		user, ok := users[sample.User]
+		if !ok || seen[sample.User+"/"+sample.Type] {
+			continue
+		}
+		seen[sample.User+"/"+sample.Type] = true
+		user.MeasurementTypes = append(user.MeasurementTypes, sample.Type)
+	}
+
+	resp := &withingspb.ListUsersResponse{}
+	for _, name := range names {
+		sort.Strings(users[name].MeasurementTypes)
+		resp.Users = append(resp.Users, users[name])
+	}
+	return resp, nil
+}
+
+func (s *measurementsServer) StreamMeasurements(req *withingspb.StreamMeasurementsRequest, stream withingspb.Measurements_StreamMeasurementsServer) error {
+	user := req.User
+	if user == "" {
+		user = primaryUser
+	}
+	if !contains(configuredAccounts(), user) {
+		return status.Errorf(codes.NotFound, "unknown user %q", req.User)
+	}
+
+	var from time.Time
+	if req.From != nil {
+		from = req.From.AsTime()
+	}
+	to := time.Now()
+	if req.To != nil {
+		to = req.To.AsTime()
+	}
+
+	for _, sample := range s.store.All() {
+		if sample.User != user || (req.Type != "" && sample.Type != req.Type) {
+			continue
+		}
+		if sample.Time.Before(from) || sample.Time.After(to) {
+			continue
+		}
+
+		err := stream.Send(&withingspb.Measurement{
+			User:      user,
+			Type:      sample.Type,
+			Time:      timestamppb.New(sample.Time),
+			Value:     sample.Value,
+			Intraday:  sample.Intraday,
+			Anomalous: sample.Anomalous,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// serveGRPC serves the Measurements service on address until it fails or,
+// once in-flight calls have finished, until ctx is done.
+func serveGRPC(ctx context.Context, address string, store *HistoryStore) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	server := grpc.NewServer()
+	withingspb.RegisterMeasurementsServer(server, &measurementsServer{store: store})
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Like the HTTP servers, give in-flight calls shutdownTimeout to finish.
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		server.Stop()
+	}
+	return nil
+}
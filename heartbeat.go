@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeatURL is pinged after every refresh cycle without failed API
+// requests, e.g. a healthchecks.io or Uptime Kuma push URL.
+var heartbeatURL = ""
+
+// apiFailures counts failed Withings API requests.
+var apiFailures int64
+
+// pingHeartbeat sends a GET request to the heartbeat URL, if one is set.
+func pingHeartbeat(ctx context.Context) {
+	if heartbeatURL == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", heartbeatURL, nil)
+	if err != nil {
+		log.Printf("Cannot ping heartbeat URL: %v", err)
+		return
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Cannot ping heartbeat URL: %v", err)
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		log.Printf("Heartbeat URL returned %s.", res.Status)
+	}
+}
+
+// failedRequests returns the number of API requests that have failed so far.
+func failedRequests() int64 {
+	return atomic.LoadInt64(&apiFailures)
+}
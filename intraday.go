@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const intradayFields = "steps,heart_rate,calories"
+
+// How far back the intraday collector looks, set with
+// --collector.intraday.window.
+var intradayWindow = time.Hour
+
+// The buckets intraday activity is downsampled to, set with
+// --collector.intraday.bucket; 0 keeps every sample.
+var intradayBucket time.Duration
+
+// intradayHistograms observes the intraday samples in native histograms, set
+// with --collector.intraday.native-histograms.
+var intradayHistograms = false
+
+// The time of the latest intraday sample observed in the histograms of each
+// account, so overlapping windows are not observed twice.
+var (
+	intradayObservedMu sync.Mutex
+	intradayObserved   = map[string]time.Time{}
+)
+
+// intradaySample is the activity of one period of intraday activity.
+type intradaySample struct {
+	start    time.Time
+	steps    float64
+	calories float64
+	// The average heart rate and the number of samples it is computed from.
+	heartRate  float64
+	heartRates int
+}
+
+// getIntradayActivity returns the high-resolution activity between start
+// and end, which may be at most 24 hours apart.
+func getIntradayActivity(ctx context.Context, accessToken string, start time.Time, end time.Time) (*IntradayActivity, error) {
+	url := fmt.Sprintf("%s/v2/measure?action=getintradayactivity&startdate=%d&enddate=%d&data_fields=%s", withingsAPIBaseURL, start.Unix(), end.Unix(), intradayFields)
+	body, err := withingsRequest(ctx, url, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	activity := &IntradayActivity{}
+	if err := json.Unmarshal(body, activity); err != nil {
+		return nil, err
+	}
+	if activity.Status != 0 {
+		return nil, fmt.Errorf("getintradayactivity returned status %d", activity.Status)
+	}
+
+	return activity, nil
+}
+
+// downsampleIntraday returns the activity in series per bucket, oldest
+// first, summing steps and calories and averaging the heart rate. With a zero
+// bucket, every sample is returned as is.
+func downsampleIntraday(activity *IntradayActivity, bucket time.Duration) []intradaySample {
+	buckets := map[int64]*intradaySample{}
+	for timestamp, sample := range activity.Body.Series {
+		t, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			continue
+		}
+		start := time.Unix(t, 0)
+		if bucket > 0 {
+			start = start.Truncate(bucket)
+		}
+		b, ok := buckets[start.Unix()]
+		if !ok {
+			b = &intradaySample{start: start}
+			buckets[start.Unix()] = b
+		}
+		b.steps += sample.Steps
+		b.calories += sample.Calories
+		if sample.HeartRate > 0 {
+			b.heartRate += (sample.HeartRate - b.heartRate) / float64(b.heartRates+1)
+			b.heartRates++
+		}
+	}
+
+	samples := make([]intradaySample, 0, len(buckets))
+	for _, b := range buckets {
+		samples = append(samples, *b)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].start.Before(samples[j].start) })
+	return samples
+}
+
+// updateIntradayMetrics summarises the intraday activity of the last
+// intradayWindow: the steps and calories in it, and the latest and average
+// heart rate. With intradayBucket, the latest heart rate is that of the last
+// bucket, and the buckets rather than every sample go to store.
+func updateIntradayMetrics(ctx context.Context, accessToken string, store *HistoryStore) {
+	now := time.Now()
+	activity, err := getIntradayActivity(ctx, accessToken, now.Add(-intradayWindow), now)
+	if err != nil {
+		log.Printf("Cannot fetch intraday activity: %v", err)
+		return
+	}
+
+	var steps, calories, heartRateSum float64
+	var heartRates int
+	var latest *intradaySample
+	var history []Sample
+	user := contextUser(ctx)
+	samples := downsampleIntraday(activity, intradayBucket)
+	for i, sample := range samples {
+		steps += sample.steps
+		calories += sample.calories
+		history = append(history,
+			Sample{User: user, Type: "intraday_steps", Time: sample.start, Value: sample.steps, Intraday: true},
+			Sample{User: user, Type: "intraday_calories", Time: sample.start, Value: sample.calories, Intraday: true})
+		if sample.heartRates == 0 {
+			continue
+		}
+		heartRateSum += sample.heartRate * float64(sample.heartRates)
+		heartRates += sample.heartRates
+		latest = &samples[i]
+		history = append(history, Sample{User: user, Type: "intraday_heart_rate", Time: sample.start, Value: sample.heartRate, Intraday: true})
+	}
+
+	intradayStepsMetric.WithLabelValues(user).Set(steps)
+	intradayCaloriesMetric.WithLabelValues(user).Set(calories)
+	if latest == nil {
+		intradayHeartRateMetric.DeleteLabelValues(user)
+		intradayHeartRateAverageMetric.DeleteLabelValues(user)
+	} else {
+		intradayHeartRateMetric.WithLabelValues(user).Set(latest.heartRate)
+		intradayHeartRateAverageMetric.WithLabelValues(user).Set(heartRateSum / float64(heartRates))
+		recordMeasurementTime(ctx, "intraday", latest.start)
+	}
+	log.Printf("Setting intraday metrics from %d samples in %d buckets.\n", len(activity.Body.Series), len(samples))
+
+	if intradayHistograms {
+		observeIntradayHistograms(ctx, activity)
+	}
+
+	if store != nil && len(history) > 0 {
+		if err := store.Add(history...); err != nil {
+			log.Printf("Cannot update history store: %v", err)
+		}
+	}
+}
+
+// observeIntradayHistograms adds the samples of activity taken since the last
+// call to the intraday native histograms.
+func observeIntradayHistograms(ctx context.Context, activity *IntradayActivity) {
+	user := contextUser(ctx)
+	intradayObservedMu.Lock()
+	defer intradayObservedMu.Unlock()
+
+	observed := intradayObserved[user]
+	latest := observed
+	for timestamp, sample := range activity.Body.Series {
+		t, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || !time.Unix(t, 0).After(observed) {
+			continue
+		}
+		if time.Unix(t, 0).After(latest) {
+			latest = time.Unix(t, 0)
+		}
+		intradayStepsHistogram.WithLabelValues(user).Observe(sample.Steps)
+		if sample.HeartRate > 0 {
+			intradayHeartRateHistogram.WithLabelValues(user).Observe(sample.HeartRate)
+		}
+	}
+	intradayObserved[user] = latest
+}
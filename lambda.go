@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// runLambda serves AWS Lambda invocations. Each invocation refreshes the
+// access tokens of every account if needed, fetches the latest measurements and pushes them to
+// target. The function's filesystem does not outlive the instance, so the
+// tokens Withings rotates on every refresh are kept in Vault.
+func runLambda(clientID string, clientSecret string, refreshToken string, target pushTarget) {
+	if clientID == "" || clientSecret == "" {
+		log.Fatal("Lambda mode needs WITHINGS_API_CLIENT_ID and WITHINGS_API_CLIENT_SECRET.")
+	}
+	if vault == nil {
+		log.Fatal("Lambda mode needs VAULT_SECRET_PATH to persist the refresh token.")
+	}
+	if target.remoteWriteURL == "" && target.cloudWatchNamespace == "" {
+		log.Fatal("Lambda mode needs PUSH_REMOTE_WRITE_URL and/or PUSH_CLOUDWATCH_NAMESPACE.")
+	}
+
+	if err := registerMetrics(); err != nil {
+		log.Fatalf("Invalid configuration file: %v", err)
+	}
+
+	// Saves every refreshed token to Vault, so the next cold start picks it
+	// up rather than the (by then revoked) WITHINGS_API_REFRESH_TOKEN.
+	accounts, err := newAccounts(clientID, clientSecret, refreshToken, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lambda.Start(func(ctx context.Context) error {
+		ctx, span := tracer.Start(ctx, "lambda invocation")
+		defer span.End()
+
+		updateAccounts(ctx, accounts, nil, collectors)
+		for _, a := range accounts {
+			if a.tokens.RefreshFailed() {
+				return fmt.Errorf("cannot refresh the access token of %s", a.name)
+			}
+		}
+
+		samples, err := gatherPushSamples(pushGatherer())
+		if err != nil {
+			return err
+		}
+
+		return pushMetrics(ctx, target, samples, time.Now())
+	})
+}
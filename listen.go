@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long in-flight requests get to finish when shutting down.
+const shutdownTimeout = 30 * time.Second
+
+// listenAddresses returns the addresses to serve HTTP on: those given with
+// --web.listen-address, or all interfaces on --metrics-port.
+func listenAddresses(addresses []string, metricsPort int) []string {
+	if len(addresses) > 0 {
+		return addresses
+	}
+	return []string{fmt.Sprintf(":%d", metricsPort)}
+}
+
+// listenPort returns the TCP port of the first of addresses that has one,
+// e.g. for registering the exporter with Consul, or metricsPort.
+func listenPort(addresses []string, metricsPort int) int {
+	for _, address := range addresses {
+		if strings.HasPrefix(address, "unix://") {
+			continue
+		}
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			continue
+		}
+		if n, err := strconv.Atoi(port); err == nil {
+			return n
+		}
+	}
+	return metricsPort
+}
+
+// listen opens a listener for address, which is either host:port or
+// unix:///path/to/socket.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix://") {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, "unix://")
+	// A socket left behind by a previous run would make Listen fail.
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// serveHTTP serves the default mux on every address, returning when any of
+// them fails or, once in-flight requests have finished, when ctx is done.
+func serveHTTP(ctx context.Context, addresses []string) error {
+	var listeners []net.Listener
+	for _, address := range addresses {
+		listener, err := listen(address)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+
+		if strings.HasPrefix(address, "unix://") {
+			log.Printf("Serving metrics on %s. Configure your reverse proxy accordingly.", address)
+		} else {
+			log.Printf("Serving metrics on http://%s/metrics. Configure your Prometheus to scrape accordingly.", displayAddress(address))
+		}
+	}
+
+	errs := make(chan error, len(listeners))
+	var servers []*http.Server
+	for _, listener := range listeners {
+		server := &http.Server{}
+		servers = append(servers, server)
+		go func(listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(listener)
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var err error
+	for _, server := range servers {
+		if shutdownErr := server.Shutdown(ctx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
+
+// displayAddress fills in localhost for addresses listening on all
+// interfaces.
+func displayAddress(address string) string {
+	if strings.HasPrefix(address, ":") {
+		return "localhost" + address
+	}
+	return address
+}
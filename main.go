@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -16,88 +21,1025 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const withingsAPIBaseURL = "https://wbsapi.withings.net"
+
+// The OAuth scopes requested during authorization, set with --oauth.scopes.
+var scopes = "user.info,user.metrics,user.activity"
+
+// The measurement types fetched through the measure API.
+var measurementTypes = []string{"weight", "hydration", "fat_ratio", "fat_mass", "fat_free_mass", "muscle_mass", "bone_mass", "heart_rate", "spo2", "pulse_wave_velocity", "vascular_age", "vo2max", "visceral_fat", "body_temperature", "skin_temperature"}
+
+// The Withings measure type of each measurement type.
+var measureTypeIDs = map[string]int{
+	"weight":              1,
+	"height":              4,
+	"fat_free_mass":       5,
+	"fat_ratio":           6,
+	"fat_mass":            8,
+	"heart_rate":          11,
+	"spo2":                54,
+	"body_temperature":    71,
+	"skin_temperature":    73,
+	"muscle_mass":         76,
+	"hydration":           77,
+	"bone_mass":           88,
+	"pulse_wave_velocity": 91,
+	"vo2max":              123,
+	"vascular_age":        155,
+	"visceral_fat":        170,
+}
+
+// The collectors that can be enabled, each of which can be scheduled
+// separately.
+var collectors = []string{"weight", "hydration", "fat_ratio", "fat_mass", "fat_free_mass", "muscle_mass", "bone_mass", "heart_rate", "spo2", "pulse_wave_velocity", "vascular_age", "vo2max", "visceral_fat", "body_temperature", "skin_temperature", "blood_pressure", "activity", "workouts", "sleep", "ecg", "devices", "goals"}
+
 func main() {
-	const withingsAPIBaseURL = "https://wbsapi.withings.net"
-	const scopes = "user.info,user.metrics"
-	var accessToken, refreshToken string
-	var expiryTime time.Time
+	if err := loadSecretFiles(); err != nil {
+		log.Fatalf("Cannot read secret: %v", err)
+	}
 
 	clientID := kingpin.Flag("api-client-id", "Withings API OAuth client ID (https://account.withings.com/partner/add_oauth2)").Default("").OverrideDefaultFromEnvar("WITHINGS_API_CLIENT_ID").String()
 	clientSecret := kingpin.Flag("api-client-secret", "Withings API OAuth client secret (https://account.withings.com/partner/add_oauth2)").Default("").OverrideDefaultFromEnvar("WITHINGS_API_CLIENT_SECRET").String()
+	apiRefreshToken := kingpin.Flag("api-refresh-token", "Withings API OAuth refresh token, used when --token-file holds no valid tokens").Default("").OverrideDefaultFromEnvar("WITHINGS_API_REFRESH_TOKEN").String()
+	tokenFile := kingpin.Flag("token-file", "File to persist OAuth tokens in, so restarts need no new authorization (empty to disable)").Default(defaultTokenFile()).OverrideDefaultFromEnvar("TOKEN_FILE").String()
+	tokenKey := kingpin.Flag("token-file.encryption-key", "Base64-encoded 32-byte key to encrypt the token file with (AES-256-GCM), e.g. from `openssl rand -base64 32`").Default("").OverrideDefaultFromEnvar("TOKEN_ENCRYPTION_KEY").String()
+	vaultAddress := kingpin.Flag("vault.address", "Address of the HashiCorp Vault server").Default("https://127.0.0.1:8200").OverrideDefaultFromEnvar("VAULT_ADDR").String()
+	vaultToken := kingpin.Flag("vault.token", "Vault token").Default("").OverrideDefaultFromEnvar("VAULT_TOKEN").String()
+	vaultSecretPath := kingpin.Flag("vault.path", "Vault KV v2 secret holding client_id, client_secret and the tokens, e.g. secret/withings-exporter (empty disables Vault)").Default("").OverrideDefaultFromEnvar("VAULT_SECRET_PATH").String()
+	decryptCheck := kingpin.Flag("decrypt-check", "Check that the token files can be read with the encryption key, then exit").Bool()
+	redirectURIFlag := kingpin.Flag("oauth.redirect-uri", "OAuth redirect URI registered as the callback URL of the Withings application; it has to reach the callback server (default: http://localhost:<oauth.callback-port>/)").Default("").OverrideDefaultFromEnvar("OAUTH_REDIRECT_URI").String()
+	scopesFlag := kingpin.Flag("oauth.scopes", "Comma-separated OAuth scopes to request, e.g. to add user.sleepevents").Default(scopes).OverrideDefaultFromEnvar("OAUTH_SCOPES").String()
+	callbackPort := kingpin.Flag("oauth.callback-port", "Port of the local server receiving the OAuth redirect during authorization").Default("8989").OverrideDefaultFromEnvar("OAUTH_CALLBACK_PORT").Int()
 	metricsPort := kingpin.Flag("metrics-port", "The port to bind to for serving metrics").Default("8080").OverrideDefaultFromEnvar("METRICS_PORT").Int()
-	metricsScrapeInterval := kingpin.Flag("scrape-interval", "Time in seconds between scrapes").Default("1800").OverrideDefaultFromEnvar("METRICS_SCRAPE_INTERVAL").Int64()
+	webListenAddresses := kingpin.Flag("web.listen-address", "Address to serve metrics on, as host:port or unix:///path/to/socket (repeatable; overrides --metrics-port)").OverrideDefaultFromEnvar("WEB_LISTEN_ADDRESS").Strings()
+	metricsScrapeInterval := kingpin.Flag("scrape-interval", "Time in seconds between refreshes of the metrics; superseded by --poll-interval").Default("1800").OverrideDefaultFromEnvar("METRICS_SCRAPE_INTERVAL").Int64()
+	pollIntervalFlag := kingpin.Flag("poll-interval", "Time between refreshes of the metrics from the Withings API, e.g. 15m (default: --scrape-interval)").Default("0s").OverrideDefaultFromEnvar("POLL_INTERVAL").Duration()
+	collectOnScrape := kingpin.Flag("collect-on-scrape", "Fetch data when /metrics is scraped instead of every --poll-interval, reusing data younger than --poll-interval").Default("false").OverrideDefaultFromEnvar("COLLECT_ON_SCRAPE").Bool()
+	configFile := kingpin.Flag("config.file", "Path to the YAML configuration file").Default("").OverrideDefaultFromEnvar("CONFIG_FILE").String()
+	schedules := kingpin.Flag("schedule", "Cron expression for refreshing a collector instead of every --poll-interval, e.g. --schedule='weight=*/30 6-9 * * *' (repeatable)").StringMap()
+	storeType := kingpin.Flag("store", "Where to keep measurement history: none, memory or file").Default("none").OverrideDefaultFromEnvar("STORE").Enum("none", "memory", "file")
+	storePath := kingpin.Flag("store.path", "Path of the history file used by --store=file").Default("withings-history.json").OverrideDefaultFromEnvar("STORE_PATH").String()
+	storeRetention := kingpin.Flag("store.retention", "How long to keep daily measurements in the history store (0 keeps them forever)").Default("43800h").OverrideDefaultFromEnvar("STORE_RETENTION").Duration()
+	storeIntradayRetention := kingpin.Flag("store.intraday-retention", "How long to keep intraday measurements in the history store (0 keeps them forever)").Default("720h").OverrideDefaultFromEnvar("STORE_INTRADAY_RETENTION").Duration()
+	apiQuotaLimit := kingpin.Flag("api.quota-limit", "Number of Withings API requests allowed per minute, used to estimate the remaining quota").Default("120").OverrideDefaultFromEnvar("API_QUOTA_LIMIT").Int()
+	apiProxyURL := kingpin.Flag("api.proxy-url", "Proxy for requests to the Withings API (default: taken from HTTP_PROXY/HTTPS_PROXY/NO_PROXY)").Default("").OverrideDefaultFromEnvar("API_PROXY_URL").String()
+	apiCAFile := kingpin.Flag("api.ca-file", "PEM bundle of extra CA certificates to trust for the Withings API, e.g. for TLS-intercepting proxies").Default("").OverrideDefaultFromEnvar("API_CA_FILE").String()
+	apiInsecureSkipVerify := kingpin.Flag("api.insecure-skip-verify", "Do not verify the Withings API's TLS certificate (insecure)").Default("false").OverrideDefaultFromEnvar("API_INSECURE_SKIP_VERIFY").Bool()
+	consulAddress := kingpin.Flag("consul.address", "Consul agent to register the exporter with, e.g. http://localhost:8500 (empty disables registration)").Default("").OverrideDefaultFromEnvar("CONSUL_HTTP_ADDR").String()
+	consulToken := kingpin.Flag("consul.token", "ACL token for the Consul agent").Default("").OverrideDefaultFromEnvar("CONSUL_HTTP_TOKEN").String()
+	consulServiceName := kingpin.Flag("consul.service-name", "Service name to register in Consul").Default("withings-exporter").OverrideDefaultFromEnvar("CONSUL_SERVICE_NAME").String()
+	consulServiceAddress := kingpin.Flag("consul.service-address", "Address to register in Consul (default: the agent's address)").Default("").OverrideDefaultFromEnvar("CONSUL_SERVICE_ADDRESS").String()
+	consulServiceTags := kingpin.Flag("consul.service-tag", "Tag to register with the service in Consul (repeatable)").Strings()
+	tracingEnabled := kingpin.Flag("tracing.enabled", "Export OpenTelemetry traces of Withings API calls over OTLP/HTTP, configured with the standard OTEL_EXPORTER_OTLP_* environment variables").Default("false").OverrideDefaultFromEnvar("TRACING_ENABLED").Bool()
+	units := kingpin.Flag("units", "Units to expose measurements in: metric, or imperial for pounds, miles and degrees Fahrenheit").Default("metric").OverrideDefaultFromEnvar("UNITS").Enum("metric", "imperial")
+	dualUnits := kingpin.Flag("units.dual", "Also expose mass and distance metrics in both metric and imperial units, e.g. withings_current_weight_kg and withings_current_weight_lb").Default("false").OverrideDefaultFromEnvar("UNITS_DUAL").Bool()
+	enableGraphQL := kingpin.Flag("web.enable-graphql", "Serve a GraphQL query endpoint over the history store at /api/graphql").Default("false").OverrideDefaultFromEnvar("WEB_ENABLE_GRAPHQL").Bool()
+	grpcListenAddress := kingpin.Flag("grpc.listen-address", "Address to serve the gRPC measurements API on, e.g. :9091; requires a history store").Default("").OverrideDefaultFromEnvar("GRPC_LISTEN_ADDRESS").String()
+	conditionalScrapes := kingpin.Flag("web.conditional-scrapes", "Send ETag and Last-Modified headers on /metrics and answer 304 Not Modified when no measurement changed").Default("false").OverrideDefaultFromEnvar("WEB_CONDITIONAL_SCRAPES").Bool()
+	googleFitClientID := kingpin.Flag("googlefit.client-id", "OAuth client ID for writing fetched measurements to Google Fit").Default("").OverrideDefaultFromEnvar("GOOGLEFIT_CLIENT_ID").String()
+	googleFitClientSecret := kingpin.Flag("googlefit.client-secret", "OAuth client secret for Google Fit").Default("").OverrideDefaultFromEnvar("GOOGLEFIT_CLIENT_SECRET").String()
+	googleFitRefreshToken := kingpin.Flag("googlefit.refresh-token", "OAuth refresh token for Google Fit; enables the Google Fit sink").Default("").OverrideDefaultFromEnvar("GOOGLEFIT_REFRESH_TOKEN").String()
+	googleFitUser := kingpin.Flag("googlefit.user", "Account whose measurements are written to Google Fit, as named in the configuration file (default: the first)").Default("").OverrideDefaultFromEnvar("GOOGLEFIT_USER").String()
+	collectorUpFlag := kingpin.Flag("metrics.collector-up", "Also expose withings_collector_up{collector}, whether the last refresh of each collector succeeded").Default("false").OverrideDefaultFromEnvar("METRICS_COLLECTOR_UP").Bool()
+	measurementTimestamps := kingpin.Flag("use-measurement-timestamps", "Expose measurements with the time they were taken rather than the scrape time, over OpenMetrics").Default("false").OverrideDefaultFromEnvar("USE_MEASUREMENT_TIMESTAMPS").Bool()
+	maxAgeFlag := kingpin.Flag("max-measurement-age", "Age after which measurements are stale, e.g. 72h (0 to never consider them stale)").Default("0s").OverrideDefaultFromEnvar("MAX_MEASUREMENT_AGE").Duration()
+	staleAction := kingpin.Flag("max-measurement-age.action", "What to do with stale measurements: flag them with withings_measurement_stale, or omit them from /metrics").Default("flag").OverrideDefaultFromEnvar("MAX_MEASUREMENT_AGE_ACTION").Enum("flag", "omit")
+	deviceLabelsFlag := kingpin.Flag("metrics.device-labels", "Label measurement metrics with the device model (device) and whether they were taken by a device or entered by hand (source)").Default("false").OverrideDefaultFromEnvar("METRICS_DEVICE_LABELS").Bool()
+	cacheTTL := kingpin.Flag("cache-ttl", "How long to reuse Withings API responses for before fetching them again, e.g. 5m (0 to always fetch)").Default("0s").OverrideDefaultFromEnvar("CACHE_TTL").Duration()
+	cacheDir := kingpin.Flag("cache.dir", "Directory to cache sleep API responses for past days in, so they are not fetched again").Default("").OverrideDefaultFromEnvar("CACHE_DIR").String()
+	maxSeries := kingpin.Flag("metrics.max-label-combinations", "Largest number of label combinations exposed per metric, protecting small Prometheus servers from cardinality explosions (0 for no limit)").Default("1000").OverrideDefaultFromEnvar("METRICS_MAX_LABEL_COMBINATIONS").Int()
+	intradayCollector := kingpin.Flag("collector.intraday", "Enable the intraday collector, summarising the high-resolution activity of e.g. a ScanWatch").Default("false").OverrideDefaultFromEnvar("COLLECTOR_INTRADAY").Bool()
+	intradayWindowFlag := kingpin.Flag("collector.intraday.window", "How much recent intraday activity the intraday collector summarises (at most 24h)").Default("1h").OverrideDefaultFromEnvar("COLLECTOR_INTRADAY_WINDOW").Duration()
+	intradayHistogramsFlag := kingpin.Flag("collector.intraday.native-histograms", "Also expose the distributions of the intraday heart rate and steps as native histograms").Default("false").OverrideDefaultFromEnvar("COLLECTOR_INTRADAY_NATIVE_HISTOGRAMS").Bool()
+	intradayBucketFlag := kingpin.Flag("collector.intraday.bucket", "Downsample intraday activity to buckets of this length, e.g. 5m (0 keeps every sample)").Default("0").OverrideDefaultFromEnvar("COLLECTOR_INTRADAY_BUCKET").Duration()
+	objectivesCollector := kingpin.Flag("collector.objectives", "Enable the objectives collector, exposing the objectives (e.g. goal weights) entered in the Withings app as withings_objective{type}").Default("false").OverrideDefaultFromEnvar("COLLECTOR_OBJECTIVES").Bool()
+	bodyScanCollector := kingpin.Flag("collector.bodyscan", "Enable the bodyscan collector, exposing the water and segmental body composition measures of a Body Scan").Default("false").OverrideDefaultFromEnvar("COLLECTOR_BODYSCAN").Bool()
+	rawCollector := kingpin.Flag("collector.raw", "Enable the raw collector, exposing the unscaled values of every measure type as withings_raw_measurement{type,unit,attrib} for debugging").Default("false").OverrideDefaultFromEnvar("COLLECTOR_RAW").Bool()
+	recordDir := kingpin.Flag("record-dir", "Write every Withings API request and response, with secrets stripped, to this directory").Default("").OverrideDefaultFromEnvar("RECORD_DIR").String()
+	replayDir := kingpin.Flag("replay-dir", "Answer Withings API requests from the recordings in this directory instead of contacting the API").Default("").OverrideDefaultFromEnvar("REPLAY_DIR").String()
+	faultInjection := kingpin.Flag("testing.fault-injection", "Allow simulating API errors, rate limits, stale data and missing metrics through /-/faults, for testing alert rules and dashboards").Default("false").OverrideDefaultFromEnvar("TESTING_FAULT_INJECTION").Bool()
+	heartbeat := kingpin.Flag("heartbeat.url", "URL to GET after every successful refresh, e.g. a healthchecks.io or Uptime Kuma push URL").Default("").OverrideDefaultFromEnvar("HEARTBEAT_URL").String()
+	offline := kingpin.Flag("offline", "Serve metrics from the history file at --store.path without contacting the Withings API").Default("false").OverrideDefaultFromEnvar("OFFLINE").Bool()
+
+	serveCmd := kingpin.Command("serve", "Serve metrics (the default)").Default()
+	importCmd := kingpin.Command("import", "Seed the history store at --store.path from exported CSV files")
+	importFormat := importCmd.Flag("format", "Format of the files to import: csv, or apple-health for an Apple Health export.zip or export.xml").Default("csv").Enum("csv", "apple-health")
+	importUser := importCmd.Flag("user", "Account the imported measurements belong to, as named in the configuration file (default: the first)").String()
+	importFiles := importCmd.Arg("file", "Files to import: a Withings weight.csv export, the output of `export` or an Apple Health export").Required().ExistingFiles()
+	exportCmd := kingpin.Command("export", "Write the history store at --store.path to standard output as CSV")
+	backfillCmd := kingpin.Command("backfill", "Push the full measurement history, with original timestamps, to a remote_write endpoint")
+	backfillURL := backfillCmd.Flag("to-remote-write", "Prometheus remote_write endpoint accepting old and out-of-order samples").Required().String()
+	backfillUsername := backfillCmd.Flag("remote-write-username", "Username for basic authentication against the remote_write endpoint").Default("").OverrideDefaultFromEnvar("PUSH_REMOTE_WRITE_USERNAME").String()
+	backfillPassword := backfillCmd.Flag("remote-write-password", "Password for basic authentication against the remote_write endpoint").Default("").OverrideDefaultFromEnvar("PUSH_REMOTE_WRITE_PASSWORD").String()
+	backfillFrom := backfillCmd.Flag("from", "Only backfill measurements taken on or after this date (YYYY-MM-DD)").Default("").String()
+	backfillUser := backfillCmd.Flag("user", "Only backfill this account, as named in the configuration file (default: every account)").String()
+	exportECGCmd := kingpin.Command("export-ecg", "Download raw ECG signals from the Withings heart API to files")
+	exportECGDir := exportECGCmd.Flag("output-dir", "Directory to write the ECG files to").Default("ecg").String()
+	exportECGFormat := exportECGCmd.Flag("format", "File format: json (signal and metadata) or csv (signal only)").Default("json").Enum("json", "csv")
+	exportECGFrom := exportECGCmd.Flag("from", "Only export recordings taken on or after this date (YYYY-MM-DD)").Default("").String()
+	exportSleepCmd := kingpin.Command("export-sleep-events", "Write per-night breathing and snoring timelines from the Withings sleep API to files")
+	exportSleepDir := exportSleepCmd.Flag("output-dir", "Directory to write the sleep files to").Default("sleep").String()
+	exportSleepFormat := exportSleepCmd.Flag("format", "File format").Default("json").Enum("json", "csv")
+	exportSleepFrom := exportSleepCmd.Flag("from", "First night to export (YYYY-MM-DD, default: 30 days ago)").Default("").String()
+	exportSleepTo := exportSleepCmd.Flag("to", "Last night to export (YYYY-MM-DD, default: today)").Default("").String()
+	lambdaCmd := kingpin.Command("lambda", "Run as an AWS Lambda function, fetching and pushing metrics once per invocation (the default inside Lambda)")
+	pushRemoteWriteURL := lambdaCmd.Flag("push.remote-write-url", "Prometheus remote_write endpoint to push metrics to").Default("").OverrideDefaultFromEnvar("PUSH_REMOTE_WRITE_URL").String()
+	pushRemoteWriteUsername := lambdaCmd.Flag("push.remote-write-username", "Username for basic authentication against the remote_write endpoint").Default("").OverrideDefaultFromEnvar("PUSH_REMOTE_WRITE_USERNAME").String()
+	pushRemoteWritePassword := lambdaCmd.Flag("push.remote-write-password", "Password for basic authentication against the remote_write endpoint").Default("").OverrideDefaultFromEnvar("PUSH_REMOTE_WRITE_PASSWORD").String()
+	pushCloudWatchNamespace := lambdaCmd.Flag("push.cloudwatch-namespace", "Publish metrics to CloudWatch under this namespace, using the embedded metric format in the function's logs").Default("").OverrideDefaultFromEnvar("PUSH_CLOUDWATCH_NAMESPACE").String()
+
+	pauseCmd := kingpin.Command("pause", "Pause background polling of a running exporter, e.g. during Withings maintenance")
+	pauseURL := pauseCmd.Flag("web.url", "URL of the running exporter").Default("http://localhost:8080").String()
+	pauseCollector := pauseCmd.Arg("collector", "Only pause this collector").String()
+	resumeCmd := kingpin.Command("resume", "Resume background polling of a running exporter")
+	resumeURL := resumeCmd.Flag("web.url", "URL of the running exporter").Default("http://localhost:8080").String()
+	resumeCollector := resumeCmd.Arg("collector", "Only resume this collector").String()
+
+	revokeCmd := kingpin.Command("revoke", "Revoke the exporter's access to your Withings account and delete the stored tokens")
+	revokeUser := revokeCmd.Flag("user", "Account to revoke, as named in the configuration file (default: the first)").String()
+	authCmd := kingpin.Command("auth", "Authorize the exporter with your Withings account and write the tokens to --token-file")
+	authUser := authCmd.Flag("user", "Account to authorize, as named in the configuration file (default: the first)").String()
+	authDemo := authCmd.Flag("demo", "Authorize access to the Withings demo user instead of your own account, for trying the exporter without a device").Bool()
+	configSchemaCmd := kingpin.Command("config-schema", "Write a JSON Schema for the configuration file to standard output, for editor and CI validation")
+	doctorCmd := kingpin.Command("doctor", "Check the configuration, credentials and Withings API access, printing a pass/fail report")
+
 	kingpin.Version("1.0.0")
-	kingpin.Parse()
+	command := kingpin.Parse()
+
+	// Lambda runs the bootstrap binary without arguments.
+	if command == serveCmd.FullCommand() && os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" {
+		command = lambdaCmd.FullCommand()
+	}
+
+	if *configFile != "" {
+		c, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Cannot load configuration file: %v", err)
+		}
+		config = c
+	}
+
+	metrics, err := newDerivedMetrics(config.DerivedMetrics)
+	if err != nil {
+		log.Fatalf("Invalid configuration file: %v", err)
+	}
+	derivedMetrics = metrics
+
+	if *units == "imperial" {
+		if *dualUnits {
+			log.Fatal("--units=imperial cannot be combined with --units.dual.")
+		}
+		imperialUnits = true
+		if config.TemperatureUnit == "" {
+			config.TemperatureUnit = "fahrenheit"
+		}
+	}
+
+	if err := setupTemperatureMetrics(config.TemperatureUnit); err != nil {
+		log.Fatalf("Invalid configuration file: %v", err)
+	}
+
+	if err := setupMeasureTypes(config.MeasureTypes); err != nil {
+		log.Fatalf("Invalid configuration file: %v", err)
+	}
+
+	if err := setupAccounts(config.Accounts); err != nil {
+		log.Fatalf("Invalid configuration file: %v", err)
+	}
+
+	if *dualUnits {
+		enableDualUnits()
+	}
+
+	if *rawCollector {
+		collectors = append(collectors, "raw")
+	}
+	if *bodyScanCollector {
+		collectors = append(collectors, "bodyscan")
+	}
+	if *objectivesCollector {
+		collectors = append(collectors, "objectives")
+	}
+	if *intradayCollector {
+		if *intradayWindowFlag <= 0 || *intradayWindowFlag > 24*time.Hour {
+			log.Fatalf("--collector.intraday.window must be between 0 and 24h, not %s.", *intradayWindowFlag)
+		}
+		intradayWindow = *intradayWindowFlag
+		if *intradayBucketFlag < 0 || *intradayBucketFlag > intradayWindow {
+			log.Fatalf("--collector.intraday.bucket must be between 0 and --collector.intraday.window, not %s.", *intradayBucketFlag)
+		}
+		intradayBucket = *intradayBucketFlag
+		intradayHistograms = *intradayHistogramsFlag
+		collectors = append(collectors, "intraday")
+	}
+
+	apiQuota.SetLimit(*apiQuotaLimit)
+
+	client, err := newAPIClient(*apiProxyURL, *apiCAFile, *apiInsecureSkipVerify)
+	if err != nil {
+		log.Fatalf("Cannot configure HTTP client: %v", err)
+	}
+	apiClient = client
+
+	switch {
+	case *replayDir != "":
+		apiClient.Transport = replayTransport{dir: *replayDir}
+		log.Printf("Replaying Withings API responses from %s.", *replayDir)
+	case *recordDir != "":
+		apiClient.Transport = recordingTransport{next: apiClient.Transport, dir: *recordDir}
+		log.Printf("Recording Withings API responses to %s.", *recordDir)
+	}
+
+	if *faultInjection {
+		transport := apiClient.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		apiClient.Transport = newFaultTransport(transport)
+		injectFaults = true
+		log.Println("Fault injection is enabled at /-/faults.")
+	}
+
+	maxLabelCombinations = *maxSeries
+	heartbeatURL = *heartbeat
+	oauthCallbackPort = *callbackPort
+	oauthRedirectURI = *redirectURIFlag
+	scopes = *scopesFlag
+
+	if *tokenKey != "" {
+		key, err := parseTokenEncryptionKey(*tokenKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tokenEncryptionKey = key
+	}
+	if *vaultSecretPath != "" {
+		vault = &vaultKV{address: *vaultAddress, token: *vaultToken}
+		vaultPath = *vaultSecretPath
+		if err := readVaultCredentials(clientID, clientSecret); err != nil {
+			log.Fatalf("Cannot read credentials from Vault: %v", err)
+		}
+	}
+	if *clientID != "" && *clientSecret != "" {
+		signer = &requestSigner{clientID: *clientID, clientSecret: *clientSecret}
+	}
+	if *decryptCheck {
+		if !checkTokenDecryption(*tokenFile) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *cacheDir != "" {
+		apiCache = &responseCache{dir: *cacheDir}
+	}
+	perCollectorUp = *collectorUpFlag
+	useMeasurementTimestamps = *measurementTimestamps
+	deviceLabels = *deviceLabelsFlag
+	maxMeasurementAge = *maxAgeFlag
+	omitStaleMeasurements = *staleAction == "omit"
+	if *cacheTTL > 0 {
+		responseTTLCache = newMemoryCache(*cacheTTL)
+	}
+
+	switch command {
+	case configSchemaCmd.FullCommand():
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(configSchema()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case authCmd.FullCommand():
+		if *clientID == "" || *clientSecret == "" {
+			log.Fatal("Authorization needs --api-client-id and --api-client-secret.")
+		}
+		user := *authUser
+		if user == "" {
+			user = primaryUser
+		}
+		_, store, err := accountConfig(user, *apiRefreshToken, *tokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		oauthDemo = *authDemo
+		if err := authorize(*clientID, *clientSecret, store); err != nil {
+			log.Fatalf("Authorization failed: %v", err)
+		}
+		return
+	case revokeCmd.FullCommand():
+		user := *revokeUser
+		if user == "" {
+			user = primaryUser
+		}
+		c, store, err := accountConfig(user, *apiRefreshToken, *tokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := revoke(context.Background(), *clientID, *clientSecret, c.RefreshToken, store); err != nil {
+			log.Fatalf("Cannot revoke access: %v", err)
+		}
+		return
+	case doctorCmd.FullCommand():
+		if !runDoctor(context.Background(), *clientID, *clientSecret, *apiRefreshToken, *schedules) {
+			os.Exit(1)
+		}
+		return
+	case pauseCmd.FullCommand():
+		if err := requestPause(*pauseURL, true, *pauseCollector); err != nil {
+			log.Fatalf("Cannot pause polling: %v", err)
+		}
+		return
+	case resumeCmd.FullCommand():
+		if err := requestPause(*resumeURL, false, *resumeCollector); err != nil {
+			log.Fatalf("Cannot resume polling: %v", err)
+		}
+		return
+	case importCmd.FullCommand():
+		user := *importUser
+		if user == "" {
+			user = primaryUser
+		}
+		if !contains(accountNames, user) {
+			log.Fatalf("Unknown account %q.", user)
+		}
+		importHistory(*storePath, *storeRetention, *storeIntradayRetention, user, *importFormat, *importFiles)
+		return
+	case exportCmd.FullCommand():
+		exportHistory(*storePath, *storeRetention, *storeIntradayRetention)
+		return
+	case backfillCmd.FullCommand():
+		from, err := parseDateFlag(*backfillFrom)
+		if err != nil {
+			log.Fatalf("Invalid --from date: %v", err)
+		}
+		if *clientID == "" || *clientSecret == "" {
+			log.Fatal("Cannot talk to the Withings API without `--api-client-id` and `--api-client-secret`.")
+		}
+
+		users := accountNames
+		if *backfillUser != "" {
+			if !contains(accountNames, *backfillUser) {
+				log.Fatalf("Unknown account %q.", *backfillUser)
+			}
+			users = []string{*backfillUser}
+		}
+		target := pushTarget{
+			remoteWriteURL:      *backfillURL,
+			remoteWriteUsername: *backfillUsername,
+			remoteWritePassword: *backfillPassword,
+		}
+		for _, user := range users {
+			tokens, err := newAccountTokenSource(*clientID, *clientSecret, user, *apiRefreshToken, *tokenFile)
+			if err != nil {
+				log.Fatalf("Cannot obtain credentials: %v", err)
+			}
+			if err := backfill(withUser(context.Background(), user), tokens, target, from); err != nil {
+				log.Fatalf("Backfill failed: %v", err)
+			}
+		}
+		return
+	case exportECGCmd.FullCommand():
+		from, err := parseDateFlag(*exportECGFrom)
+		if err != nil {
+			log.Fatalf("Invalid --from date: %v", err)
+		}
+		if *clientID == "" || *clientSecret == "" {
+			log.Fatal("Cannot talk to the Withings API without `--api-client-id` and `--api-client-secret`.")
+		}
+
+		tokens, err := newAccountTokenSource(*clientID, *clientSecret, primaryUser, *apiRefreshToken, *tokenFile)
+		if err != nil {
+			log.Fatalf("Cannot obtain credentials: %v", err)
+		}
+		if err := exportECGs(context.Background(), tokens, *exportECGDir, *exportECGFormat, from); err != nil {
+			log.Fatalf("ECG export failed: %v", err)
+		}
+		return
+	case exportSleepCmd.FullCommand():
+		from, err := parseDateFlag(*exportSleepFrom)
+		if err != nil {
+			log.Fatalf("Invalid --from date: %v", err)
+		}
+		to, err := parseDateFlag(*exportSleepTo)
+		if err != nil {
+			log.Fatalf("Invalid --to date: %v", err)
+		}
+		if to.IsZero() {
+			to = time.Now()
+		}
+		if from.IsZero() {
+			from = to.AddDate(0, 0, -30)
+		}
+		if *clientID == "" || *clientSecret == "" {
+			log.Fatal("Cannot talk to the Withings API without `--api-client-id` and `--api-client-secret`.")
+		}
+
+		tokens, err := newAccountTokenSource(*clientID, *clientSecret, primaryUser, *apiRefreshToken, *tokenFile)
+		if err != nil {
+			log.Fatalf("Cannot obtain credentials: %v", err)
+		}
+		if err := exportSleepEvents(context.Background(), tokens, *exportSleepDir, *exportSleepFormat, from, to); err != nil {
+			log.Fatalf("Sleep export failed: %v", err)
+		}
+		return
+	case lambdaCmd.FullCommand():
+		target := pushTarget{
+			remoteWriteURL:      *pushRemoteWriteURL,
+			remoteWriteUsername: *pushRemoteWriteUsername,
+			remoteWritePassword: *pushRemoteWritePassword,
+			cloudWatchNamespace: *pushCloudWatchNamespace,
+		}
+		runLambda(*clientID, *clientSecret, *apiRefreshToken, target)
+		return
+	case serveCmd.FullCommand():
+	}
+
+	if *tracingEnabled {
+		shutdown, err := setupTracing(context.Background())
+		if err != nil {
+			log.Fatalf("Cannot set up tracing: %v", err)
+		}
+		defer shutdown(context.Background())
+	}
+
+	pollInterval := time.Duration(*metricsScrapeInterval) * time.Second
+	if *pollIntervalFlag > 0 {
+		pollInterval = *pollIntervalFlag
+	}
+	if pollInterval <= 0 {
+		log.Fatalf("The poll interval must be positive, not %s.", pollInterval)
+	}
+
+	if *offline {
+		serveOffline(*storePath, listenAddresses(*webListenAddresses, *metricsPort), pollInterval, *enableGraphQL, *grpcListenAddress, *conditionalScrapes)
+		return
+	}
 
 	if *clientID == "" || *clientSecret == "" {
 		log.Println("Cannot talk to the Withings API. Pass `--api-client-id` and/or `--api-client-secret` flags with values. Or set `WITHINGS_API_CLIENT_ID` or `WITHINGS_API_CLIENT_SECRET` environment variables.")
 		os.Exit(1)
 	}
 
-	if accessToken == "" {
-		accessToken, refreshToken, expiryTime = oauthFlow(withingsAPIBaseURL, *clientID, *clientSecret, scopes, "", false)
+	cronSchedules := map[string]*cronSchedule{}
+	for name, expr := range *schedules {
+		if !contains(collectors, name) {
+			log.Fatalf("Cannot schedule unknown collector %q; known collectors are %s.", name, strings.Join(collectors, ", "))
+		}
+
+		schedule, err := parseCronSchedule(expr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cronSchedules[name] = schedule
 	}
 
-	registerMetrics()
+	initialAccounts, err := newAccounts(*clientID, *clientSecret, *apiRefreshToken, *tokenFile)
+	if err != nil {
+		log.Fatalf("Cannot obtain credentials: %v", err)
+	}
+	accounts := &accountSet{accounts: initialAccounts}
 
-	ticker := time.NewTicker(time.Duration(*metricsScrapeInterval) * time.Second)
+	if *googleFitRefreshToken != "" {
+		user := *googleFitUser
+		if user == "" {
+			user = primaryUser
+		}
+		if !contains(accountNames, user) {
+			log.Fatalf("Unknown --googlefit.user %q.", user)
+		}
+		sinks = append(sinks, newGoogleFitSink(user, *googleFitClientID, *googleFitClientSecret, *googleFitRefreshToken))
+	}
+
+	var store *HistoryStore
+	if *storeType != "none" {
+		path := ""
+		if *storeType == "file" {
+			path = *storePath
+		}
+
+		var err error
+		store, err = NewHistoryStore(path, *storeRetention, *storeIntradayRetention)
+		if err != nil {
+			log.Fatalf("Cannot open history store: %v", err)
+		}
+	}
+
+	if err := registerMetrics(); err != nil {
+		log.Fatalf("Invalid configuration file: %v", err)
+	}
+
+	// Stop polling and serving on SIGTERM, e.g. when the container is
+	// stopped. The pollers finish their running refresh before returning.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var background sync.WaitGroup
+
+	var intervalCollectors []string
+	for _, name := range collectors {
+		if _, ok := cronSchedules[name]; !ok {
+			intervalCollectors = append(intervalCollectors, name)
+		}
+	}
+
+	for name, schedule := range cronSchedules {
+		background.Add(1)
+		go func(name string, schedule *cronSchedule) {
+			defer background.Done()
+			for {
+				next := schedule.Next(time.Now())
+				if next.IsZero() {
+					log.Printf("Schedule for %s never fires again.", name)
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Until(next)):
+				}
+				if polling.Paused(name) {
+					log.Printf("Not updating %s data: polling is paused.", name)
+					continue
+				}
+
+				ctx, span := tracer.Start(context.Background(), "scheduled refresh "+name)
+				log.Printf("Updating %s data...", name)
+				updateAccounts(ctx, accounts.List(), store, []string{name})
+				span.End()
+			}
+		}(name, schedule)
+	}
+
+	refresh := func(ctx context.Context) {
+		active := polling.Active(intervalCollectors)
+		if len(active) < len(intervalCollectors) {
+			log.Println("Polling is paused for some collectors.")
+		}
+		if len(active) > 0 {
+			ctx, span := tracer.Start(ctx, "refresh cycle")
+			log.Println("Updating data...")
+			updateAccounts(ctx, accounts.List(), store, active)
+			span.End()
+		}
+	}
+	if *collectOnScrape {
+		onScrape = &scrapeRefresher{maxAge: pollInterval, refresh: refresh}
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	background.Add(1)
 	go func() {
+		defer background.Done()
 		for {
 			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				return
 			case <-ticker.C:
-				if time.Now().After(expiryTime) {
-					log.Println("Refreshing credentials...")
-					accessToken, refreshToken, expiryTime = oauthFlow(withingsAPIBaseURL, *clientID, *clientSecret, scopes, refreshToken, true)
+				if onScrape == nil {
+					refresh(context.Background())
 				}
 
-				log.Println("Updating data...")
-				updateMetrics(
-					currentWeightMetric, getMeasurements(withingsAPIBaseURL, accessToken, "weight"),
-					hydrationMetric, getMeasurements(withingsAPIBaseURL, accessToken, "hydration"),
-				)
+				if store != nil {
+					// Prune even when nothing new arrived, so old history does
+					// not linger just because the scale has not been used.
+					if removed, err := store.Prune(time.Now()); err != nil {
+						log.Printf("Cannot prune history store: %v", err)
+					} else if removed > 0 {
+						log.Printf("Pruned %d samples from the history store.", removed)
+					}
+				}
+			}
+		}
+	}()
+
+	// Apply changes to the accounts in the configuration file on SIGHUP.
+	reloader := &accountReloader{path: *configFile, clientID: *clientID, clientSecret: *clientSecret, refreshToken: *apiRefreshToken, tokenFile: *tokenFile, accounts: accounts, store: store}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("Reloading configuration file...")
+			if err := reloader.Reload(context.Background()); err != nil {
+				log.Printf("Cannot reload configuration file: %v", err)
 			}
 		}
 	}()
 
 	log.Println("Getting initial values...")
-	updateMetrics(
-		currentWeightMetric, getMeasurements(withingsAPIBaseURL, accessToken, "weight"),
-		hydrationMetric, getMeasurements(withingsAPIBaseURL, accessToken, "hydration"),
+	updateAccounts(context.Background(), accounts.List(), store, collectors)
+	if onScrape != nil {
+		onScrape.last = time.Now()
+	}
+
+	http.Handle("/metrics", metricsHandler(*conditionalScrapes))
+	http.Handle("/probe", probeHandler(accounts, store))
+	http.HandleFunc("/sd", sdHandler)
+	http.HandleFunc("/-/healthy", healthyHandler)
+	http.HandleFunc("/api/openapi.json", openAPIHandler)
+	if injectFaults {
+		http.HandleFunc("/-/faults", faultsHandler)
+	}
+	http.Handle("/-/pause", pauseHandler(true))
+	http.Handle("/-/resume", pauseHandler(false))
+	http.Handle("/-/reload", reloadHandler(reloader))
+	if store != nil {
+		registerStoreHandlers(store, *enableGraphQL)
+		startGRPC(ctx, *grpcListenAddress, store, &background)
+	} else if *grpcListenAddress != "" {
+		log.Printf("Not serving the gRPC API: it requires --store.")
+	}
+
+	if *consulAddress != "" {
+		if err := registerWithConsul(*consulAddress, *consulToken, *consulServiceName, *consulServiceAddress, listenPort(listenAddresses(*webListenAddresses, *metricsPort), *metricsPort), *consulServiceTags); err != nil {
+			log.Printf("Cannot register with Consul: %v", err)
+		} else {
+			log.Printf("Registered with Consul at %s as %s.", *consulAddress, *consulServiceName)
+		}
+	}
+	if err := serveHTTP(ctx, listenAddresses(*webListenAddresses, *metricsPort)); err != nil {
+		log.Fatal(err)
+	}
+	background.Wait()
+	if onScrape != nil {
+		onScrape.Wait()
+	}
+	for _, a := range accounts.List() {
+		a.tokens.Flush()
+	}
+	log.Println("Shut down.")
+}
+
+// updateCollectors refreshes the metrics of the named collectors.
+func updateCollectors(ctx context.Context, accessToken string, store *HistoryStore, names []string) {
+	failures := failedRequests()
+
+	var types []string
+	for _, name := range names {
+		before := failedRequests()
+		switch name {
+		case "sleep":
+			updateSleepMetrics(ctx, accessToken, store)
+		case "ecg":
+			updateECGMetrics(ctx, accessToken)
+		case "raw":
+			updateRawMetrics(ctx, accessToken)
+		case "blood_pressure":
+			updateBloodPressureMetrics(ctx, accessToken)
+		case "bodyscan":
+			updateBodyScanMetrics(ctx, accessToken)
+		case "objectives":
+			updateObjectiveMetrics(ctx, accessToken)
+		case "intraday":
+			updateIntradayMetrics(ctx, accessToken, store)
+		case "devices":
+			updateDeviceMetrics(ctx, accessToken)
+		case "activity":
+			updateActivityMetrics(ctx, accessToken, store)
+		case "workouts":
+			updateWorkoutMetrics(ctx, accessToken)
+		case "goals":
+			updateGoalMetrics(ctx, accessToken)
+		default:
+			types = append(types, name)
+			continue
+		}
+		recordCollectorUp(ctx, name, failedRequests() == before)
+	}
+
+	if len(types) > 0 {
+		updateMeasurements(ctx, accessToken, store, types)
+	}
+
+	updateBodyComposition(ctx)
+	updateGoalProgress(ctx)
+	updateDerivedMetrics(ctx)
+
+	if failedRequests() == failures {
+		pingHeartbeat(ctx)
+	}
+}
+
+// updateMeasurements fetches the latest value of each of measurementTypes,
+// updates their metrics and records them in store if it is not nil.
+func updateMeasurements(ctx context.Context, accessToken string, store *HistoryStore, measurementTypes []string) {
+	ctx, span := tracer.Start(ctx, "update")
+	defer span.End()
+
+	var samples []Sample
+	for _, measurementType := range measurementTypes {
+		// Only fetch the history the trends need, falling back to the
+		// latest measurements if none were taken in that time. Whole days
+		// keep the request cacheable with --cache-ttl.
+		since := time.Now().Add(-liveHistoryWindow()).Truncate(24 * time.Hour)
+		history, err := getMeasurementHistory(ctx, withingsAPIBaseURL, accessToken, measurementType, since)
+		if err == nil && len(history) == 0 {
+			history, err = getLatestMeasurements(ctx, withingsAPIBaseURL, accessToken, measurementType)
+		}
+		recordCollectorUp(ctx, measurementType, err == nil)
+		if err != nil {
+			// Keep exposing the previous value rather than a bogus 0.
+			log.Printf("Cannot fetch %s measurements: %v", measurementType, err)
+			continue
+		}
+		if len(history) == 0 {
+			log.Printf("No %s measurements returned.", measurementType)
+			continue
+		}
+
+		// Flag the measurements in history itself, so the trends computed
+		// from it leave them out too.
+		flagAnomalies(ctx, history)
+		latest := history[0]
+
+		updateMetric(ctx, measurementType, latest.Value)
+		recordMeasurementTime(ctx, measurementType, latest.Time)
+		recordMeasurementOrigin(ctx, accessToken, measurementType, latest.DeviceID, latest.Source)
+		if measurementType == "weight" {
+			updateBMI(ctx, accessToken, latest.Value)
+			updateWeightChangeRate(ctx, history)
+			updateWeightMovingAverages(ctx, history)
+			updateWeightChange(ctx, history)
+		}
+
+		samples = append(samples, latest)
+	}
+
+	if store != nil {
+		if err := store.Add(samples...); err != nil {
+			log.Printf("Cannot update history store: %v", err)
+		}
+		updateAggregateMetrics(store, contextUser(ctx))
+	}
+
+	writeToSinks(ctx, samples)
+}
+
+// parseDateFlag parses a YYYY-MM-DD date in local time; an empty string
+// yields the zero time.
+func parseDateFlag(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// serveOffline serves the latest values from the history store, re-reading it
+// every interval so fixtures can be swapped while the exporter runs.
+func serveOffline(storePath string, addresses []string, interval time.Duration, enableGraphQL bool, grpcListenAddress string, conditionalScrapes bool) {
+	// Offline mode never prunes, so old fixtures stay usable.
+	store, err := NewHistoryStore(storePath, 0, 0)
+	if err != nil {
+		log.Fatalf("Cannot open history store: %v", err)
+	}
+
+	if err := registerMetrics(); err != nil {
+		log.Fatalf("Invalid configuration file: %v", err)
+	}
+
+	update := func() {
+		if err := store.Reload(); err != nil {
+			log.Printf("Cannot reload history store: %v", err)
+			return
+		}
+
+		for _, user := range configuredAccounts() {
+			ctx := withUser(context.Background(), user)
+			for _, measurementType := range measurementTypes {
+				sample, ok := store.Latest(user, measurementType)
+				if !ok {
+					continue
+				}
+				updateMetric(ctx, measurementType, sample.Value)
+				recordMeasurementTime(ctx, measurementType, sample.Time)
+				recordMeasurementOrigin(ctx, "", measurementType, sample.DeviceID, sample.Source)
+			}
+			weights := store.Samples(user, "weight", time.Time{}, time.Now())
+			updateWeightChangeRate(ctx, weights)
+			updateWeightMovingAverages(ctx, weights)
+			updateWeightChange(ctx, weights)
+			updateBodyComposition(ctx)
+			updateDerivedMetrics(ctx)
+			updateAggregateMetrics(store, user)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			log.Println("Reloading history store...")
+			update()
+		}
+	}()
+
+	log.Printf("Offline mode: reading measurements from %s.", storePath)
+	update()
+
+	http.Handle("/metrics", metricsHandler(conditionalScrapes))
+	http.HandleFunc("/-/healthy", healthyHandler)
+	http.HandleFunc("/api/openapi.json", openAPIHandler)
+	if injectFaults {
+		http.HandleFunc("/-/faults", faultsHandler)
+	}
+	registerStoreHandlers(store, enableGraphQL)
+	serveCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var grpcServer sync.WaitGroup
+	startGRPC(serveCtx, grpcListenAddress, store, &grpcServer)
+
+	if err := serveHTTP(serveCtx, addresses); err != nil {
+		log.Fatal(err)
+	}
+	grpcServer.Wait()
+}
+
+// registerStoreHandlers registers the read APIs over the history store.
+func registerStoreHandlers(store *HistoryStore, enableGraphQL bool) {
+	http.Handle("/api/aggregates", aggregatesHandler(store))
+
+	if enableGraphQL {
+		schema, err := newGraphQLSchema(store)
+		if err != nil {
+			log.Fatalf("Cannot build GraphQL schema: %v", err)
+		}
+		http.Handle("/api/graphql", graphQLHandler(schema))
+	}
+}
+
+// startGRPC serves the gRPC API in the background until ctx is done, if an
+// address is set. wg is done once the server has stopped.
+func startGRPC(ctx context.Context, address string, store *HistoryStore, wg *sync.WaitGroup) {
+	if address == "" {
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := serveGRPC(ctx, address, store); err != nil {
+			log.Fatalf("Cannot serve gRPC API: %v", err)
+		}
+	}()
+	log.Printf("Serving the gRPC measurements API on %s.", address)
+}
+
+// metricsHandler serves the registered metrics with the configured overrides
+// applied. Scrapes can be restricted to some collectors with one or more
+// collector query parameters, e.g. /metrics?collector=sleep, and to one
+// account with a user query parameter. If conditional is set, scrapers that
+// already have the latest measurements get a 304. With --collect-on-scrape,
+// stale data is refreshed first.
+func metricsHandler(conditional bool) http.Handler {
+	return promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			user := query.Get("user")
+			if user != "" && !contains(configuredAccounts(), user) {
+				http.Error(w, fmt.Sprintf("unknown user %q", user), http.StatusNotFound)
+				return
+			}
+
+			if onScrape != nil {
+				// Serve what is there when Prometheus is about to give up.
+				ctx, cancel := scrapeContext(r)
+				onScrape.Refresh(ctx)
+				cancel()
+			}
+
+			var gatherer prometheus.Gatherer = accountsGatherer{cardinalityGuard{prometheus.DefaultGatherer}}
+			if user != "" {
+				gatherer = userGatherer{gatherer, user}
+			}
+			if injectFaults {
+				gatherer = faultGatherer{gatherer}
+			}
+			names := query["collector"]
+			if len(names) > 0 {
+				for _, name := range names {
+					if name != exporterCollector && !contains(collectors, name) {
+						http.Error(w, fmt.Sprintf("unknown collector %q", name), http.StatusBadRequest)
+						return
+					}
+				}
+				gatherer = collectorGatherer{gatherer, names}
+			} else {
+				names = append([]string{exporterCollector}, collectors...)
+			}
+
+			if conditional {
+				version, err := currentScrapeVersion(names)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if notModified(w, r, version) {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+
+			metricsHandlerFor(gatherer).ServeHTTP(w, r)
+		}),
 	)
+}
 
-	http.Handle("/metrics", promhttp.Handler())
-	log.Printf("Serving metrics on http://localhost:%d/metrics. Configure your Prometheus to scrape accordingly.", *metricsPort)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *metricsPort), nil))
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "Healthy")
 }
 
-func oauthFlow(withingsAPIBaseURL string, clientID string, clientSecret string, scopes string, refreshToken string, isRefresh bool) (string, string, time.Time) {
-	var url string
+// importHistory adds the samples in files to the history store as samples of
+// the named account.
+func importHistory(storePath string, retention time.Duration, intradayRetention time.Duration, user string, format string, files []string) {
+	store, err := NewHistoryStore(storePath, retention, intradayRetention)
+	if err != nil {
+		log.Fatalf("Cannot open history store: %v", err)
+	}
 
-	if !isRefresh {
-		authCode := ""
-		fmt.Printf("Go to https://account.withings.com/oauth2_user/authorize2?response_type=code&client_id=%s&scope=%s&state=issyl0-withings&redirect_uri=http://localhost\n", clientID, scopes)
-		fmt.Println("Enter the value of `code` from the returned query string:")
-		fmt.Scanln(&authCode)
+	for _, file := range files {
+		var samples []Sample
+		switch format {
+		case "csv":
+			var f *os.File
+			f, err = os.Open(file)
+			if err != nil {
+				log.Fatal(err)
+			}
+			samples, err = readCSV(f)
+			f.Close()
+		case "apple-health":
+			samples, err = readAppleHealthFile(file)
+		}
+		if err != nil {
+			log.Fatalf("Cannot read %s: %v", file, err)
+		}
+		for i := range samples {
+			if samples[i].User == "" {
+				samples[i].User = user
+			}
+		}
+		if format == "apple-health" {
+			samples = withoutDuplicates(store, samples)
+		}
 
-		url = fmt.Sprintf("%s/v2/oauth2?action=requesttoken&grant_type=authorization_code&client_id=%s&client_secret=%s&code=%s&redirect_uri=http://localhost", withingsAPIBaseURL, clientID, clientSecret, authCode)
-	} else {
-		url = fmt.Sprintf("%s/v2/oauth2?action=requesttoken&grant_type=refresh_token&client_id=%s&client_secret=%s&refresh_token=%s&redirect_uri=http://localhost", withingsAPIBaseURL, clientID, clientSecret, refreshToken)
+		if err := store.Add(samples...); err != nil {
+			log.Fatalf("Cannot update history store: %v", err)
+		}
+		log.Printf("Imported %d samples from %s.", len(samples), file)
 	}
+}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", url, nil)
+func exportHistory(storePath string, retention time.Duration, intradayRetention time.Duration) {
+	store, err := NewHistoryStore(storePath, retention, intradayRetention)
 	if err != nil {
-		fmt.Println(err)
+		log.Fatalf("Cannot open history store: %v", err)
+	}
+
+	if err := writeHistoryCSV(os.Stdout, store.All()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func oauthFlow(ctx context.Context, withingsAPIBaseURL string, clientID string, clientSecret string, scopes string, refreshToken string, isRefresh bool) (string, string, time.Time) {
+	var url string
+
+	if !isRefresh {
+		state, err := newOAuthState()
+		if err != nil {
+			log.Printf("Cannot generate OAuth state: %v", err)
+			return "", "", time.Time{}
+		}
+		mode := ""
+		if oauthDemo {
+			mode = "&mode=demo"
+		}
+		fmt.Printf("Go to https://account.withings.com/oauth2_user/authorize2?response_type=code&client_id=%s&scope=%s&state=%s&redirect_uri=%s%s\n", clientID, scopes, state, redirectURIParam(), mode)
+		fmt.Println("Waiting for the authorization redirect...")
+		authCode, err := waitForAuthorizationCode(ctx, state)
+		if err != nil {
+			log.Printf("Cannot complete the authorization: %v", err)
+			return "", "", time.Time{}
+		}
+
+		url = fmt.Sprintf("%s/v2/oauth2?action=requesttoken&grant_type=authorization_code&client_id=%s&client_secret=%s&code=%s&redirect_uri=%s", withingsAPIBaseURL, clientID, clientSecret, authCode, redirectURIParam())
+	} else {
+		url = refreshTokenURL(withingsAPIBaseURL, clientID, clientSecret, refreshToken)
 	}
 
-	res, err := client.Do(req)
+	body, err := withingsRequest(ctx, url, "")
 	if err != nil {
 		fmt.Println(err)
 	}
 
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-
 	parsedRequestToken := RequestToken{}
 	json.Unmarshal(body, &parsedRequestToken)
 
@@ -106,57 +1048,150 @@ func oauthFlow(withingsAPIBaseURL string, clientID string, clientSecret string,
 	return parsedRequestToken.Body.AccessToken, parsedRequestToken.Body.RefreshToken, expiryTime
 }
 
+// refreshTokenURL returns the URL exchanging refreshToken for new tokens.
+func refreshTokenURL(withingsAPIBaseURL string, clientID string, clientSecret string, refreshToken string) string {
+	return fmt.Sprintf("%s/v2/oauth2?action=requesttoken&grant_type=refresh_token&client_id=%s&client_secret=%s&refresh_token=%s&redirect_uri=%s", withingsAPIBaseURL, clientID, clientSecret, refreshToken, redirectURIParam())
+}
+
 func tokenExpiryTime(issuedTime time.Time, expiresIn int64) time.Time {
 	return issuedTime.Add(time.Second * time.Duration(expiresIn))
 }
 
-func getMeasurements(withingsAPIBaseURL string, accessToken string, measurementType string) float64 {
-	var measurementAPIType int
-	switch measurementType {
-	case "weight":
-		measurementAPIType = 1
-	case "hydration":
-		measurementAPIType = 77
+// getMeasurementHistory returns every measurement of the given type taken
+// since the given time (or ever, if it is zero), newest first. Walking the
+// whole history takes a request per page, so only backfills pass a zero time.
+func getMeasurementHistory(ctx context.Context, withingsAPIBaseURL string, accessToken string, measurementType string, since time.Time) ([]Sample, error) {
+	var samples []Sample
+	offset := 0
+	for {
+		page, next, err := getMeasurementPage(ctx, withingsAPIBaseURL, accessToken, measurementType, since, offset)
+		if err != nil {
+			return samples, err
+		}
+		samples = append(samples, page...)
+
+		// Large histories are returned in pages.
+		if next <= offset {
+			return samples, nil
+		}
+		offset = next
 	}
+}
+
+// getLatestMeasurements returns the most recent measurements of the given
+// type, however old, newest first. It only fetches the first page.
+func getLatestMeasurements(ctx context.Context, withingsAPIBaseURL string, accessToken string, measurementType string) ([]Sample, error) {
+	samples, _, err := getMeasurementPage(ctx, withingsAPIBaseURL, accessToken, measurementType, time.Time{}, 0)
+	return samples, err
+}
 
-	url := fmt.Sprintf("%s/measure?action=getmeas&meastypes=%d&category=1&lastupdate=integer", withingsAPIBaseURL, measurementAPIType)
-	method := "POST"
+// getMeasurementPage returns the page of measurements of the given type at
+// offset, and the offset of the next page, which is not after offset if
+// there is none.
+func getMeasurementPage(ctx context.Context, withingsAPIBaseURL string, accessToken string, measurementType string, since time.Time, offset int) ([]Sample, int, error) {
+	measurementAPIType, ok := measureTypeIDs[measurementType]
+	if !ok {
+		return nil, 0, nil
+	}
 
-	client := &http.Client{}
-	req, err := http.NewRequest(method, url, nil)
-	if err != nil {
-		fmt.Println(err)
+	url := fmt.Sprintf("%s/measure?action=getmeas&meastypes=%d&category=%d", withingsAPIBaseURL, measurementAPIType, measureCategoryReal)
+	if !since.IsZero() {
+		url += fmt.Sprintf("&startdate=%d", since.Unix())
+	}
+	if offset > 0 {
+		url += fmt.Sprintf("&offset=%d", offset)
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
 
-	res, err := client.Do(req)
+	body, err := withingsRequest(ctx, url, accessToken)
 	if err != nil {
-		fmt.Println(err)
+		return nil, 0, err
 	}
 
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-
 	parsedMeasures := Measures{}
-	json.Unmarshal(body, &parsedMeasures)
+	if err := json.Unmarshal(body, &parsedMeasures); err != nil {
+		return nil, 0, err
+	}
+	if parsedMeasures.Status != 0 {
+		return nil, 0, fmt.Errorf("getmeas returned status %d", parsedMeasures.Status)
+	}
 
-	if measurementType == "weight" || measurementType == "hydration" {
-		return parsedMeasures.Body.MeasureGroups[0].Measures[0].Value / 1000
+	var samples []Sample
+	for _, group := range parsedMeasures.Body.MeasureGroups {
+		for _, measure := range group.Measures {
+			if measure.Type != measurementAPIType {
+				continue
+			}
+
+			// Values are integers scaled by a power of ten given as the unit.
+			samples = append(samples, Sample{
+				User:     contextUser(ctx),
+				Type:     measurementType,
+				Time:     time.Unix(group.Date, 0),
+				Value:    measure.Value * math.Pow10(measure.Unit),
+				DeviceID: group.DeviceID,
+				Source:   measurementSourceName(group.Attrib),
+			})
+		}
 	}
 
-	return 0.0
+	if parsedMeasures.Body.More == 0 {
+		return samples, offset, nil
+	}
+	return samples, parsedMeasures.Body.Offset, nil
 }
 
-func updateMetrics(currentWeightMetric prometheus.Gauge, currentWeight float64, hydrationMetric prometheus.Gauge, hydration float64) {
-	currentWeight, err := strconv.ParseFloat(fmt.Sprintf("%.1f", currentWeight), 64)
-	hydration, err = strconv.ParseFloat(fmt.Sprintf("%.1f", hydration), 64)
+func updateMetric(ctx context.Context, measurementType string, value float64) {
+	user := contextUser(ctx)
+	setLatestValue(ctx, measurementType, value)
+	updateDualUnitMetrics(user, measurementType, value)
 
+	value, err := strconv.ParseFloat(fmt.Sprintf("%.1f", exposedValue(measurementType, value)), 64)
 	if err != nil {
 		fmt.Println(err)
 	}
 
-	log.Printf("Setting withings_current_weight metric to %.1f kg.\n", currentWeight)
-	currentWeightMetric.Set(currentWeight)
-	log.Printf("Setting withings_current_hydration metric to %.1f/kg.\n", hydration)
-	hydrationMetric.Set(hydration)
+	switch measurementType {
+	case "weight":
+		log.Printf("Setting withings_current_weight metric to %.1f kg.\n", value)
+		currentWeightMetric.WithLabelValues(user).Set(value)
+	case "hydration":
+		log.Printf("Setting withings_current_hydration metric to %.1f/kg.\n", value)
+		hydrationMetric.WithLabelValues(user).Set(value)
+		hydrationKgMetric.WithLabelValues(user).Set(value)
+	case "bmi":
+		log.Printf("Setting withings_bmi metric to %.1f.\n", value)
+		bmiMetric.WithLabelValues(user).Set(value)
+	case "heart_rate":
+		log.Printf("Setting withings_heart_rate_bpm metric to %.0f bpm.\n", value)
+		heartRateMetric.WithLabelValues(user).Set(value)
+	case "spo2":
+		log.Printf("Setting withings_spo2_percent metric to %.1f%%.\n", value)
+		spo2Metric.WithLabelValues(user).Set(value)
+	case "pulse_wave_velocity":
+		log.Printf("Setting withings_pulse_wave_velocity_meters_per_second metric to %.1f m/s.\n", value)
+		pulseWaveVelocityMetric.WithLabelValues(user).Set(value)
+	case "vascular_age":
+		log.Printf("Setting withings_vascular_age_years metric to %.0f.\n", value)
+		vascularAgeMetric.WithLabelValues(user).Set(value)
+	case "vo2max":
+		log.Printf("Setting withings_vo2max metric to %.1f ml/min/kg.\n", value)
+		vo2maxMetric.WithLabelValues(user).Set(value)
+	case "visceral_fat":
+		log.Printf("Setting withings_visceral_fat metric to %.1f.\n", value)
+		visceralFatMetric.WithLabelValues(user).Set(value)
+	case "fat_ratio":
+		log.Printf("Setting withings_fat_ratio_percent metric to %.1f%%.\n", value)
+		fatRatioMetric.WithLabelValues(user).Set(value)
+	case "fat_mass", "fat_free_mass", "muscle_mass", "bone_mass":
+		log.Printf("Setting %s metric to %.1f kg.\n", measurementMetricNames[measurementType], value)
+		bodyCompositionMetrics[measurementType].WithLabelValues(user).Set(value)
+	case "body_temperature", "skin_temperature":
+		log.Printf("Setting %s metric to %.1f.\n", measurementMetricNames[measurementType], value)
+		temperatureMetrics[measurementType].WithLabelValues(user).Set(value)
+	default:
+		if gauge, ok := configuredMeasureMetrics[measurementType]; ok {
+			log.Printf("Setting %s metric to %.1f.\n", measurementMetricNames[measurementType], value)
+			gauge.WithLabelValues(user).Set(value)
+		}
+	}
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MeasureTypeConfig exports a Withings measure type the exporter has no
+// metric for.
+type MeasureTypeConfig struct {
+	// Metric name, e.g. withings_visceral_fat. The measurement type is the
+	// name without the withings_ prefix.
+	Metric string `yaml:"metric"`
+	Help   string `yaml:"help"`
+	// Base unit of the values, kg or m, for the variants exposed with
+	// --units.dual.
+	Unit string `yaml:"unit"`
+}
+
+// The gauges of the measure types in the configuration file, keyed by
+// measurement type.
+var configuredMeasureMetrics = map[string]*prometheus.GaugeVec{}
+
+// setupMeasureTypes adds the measure types in the configuration file to the
+// measurement types and collectors.
+func setupMeasureTypes(configs map[int]MeasureTypeConfig) error {
+	for id, c := range configs {
+		for name, known := range measureTypeIDs {
+			if known == id {
+				return fmt.Errorf("measure type %d is already exported as %s; rename it under metrics instead", id, measurementMetricNames[name])
+			}
+		}
+		if !metricNamePattern.MatchString(c.Metric) || !strings.HasPrefix(c.Metric, "withings_") {
+			return fmt.Errorf("measure type %d: invalid metric name %q; it must start with withings_", id, c.Metric)
+		}
+		measurementType := strings.TrimPrefix(c.Metric, "withings_")
+		if contains(collectors, measurementType) {
+			return fmt.Errorf("measure type %d: %s clashes with an existing collector", id, measurementType)
+		}
+		if c.Unit != "" {
+			if _, ok := dualUnitVariants[c.Unit]; !ok {
+				return fmt.Errorf("measure type %d: unknown unit %q; use kg or m", id, c.Unit)
+			}
+			measurementUnits[measurementType] = c.Unit
+		}
+
+		help := c.Help
+		if help == "" {
+			help = fmt.Sprintf("Shows the latest measurement of Withings measure type %d", id)
+		}
+		configuredMeasureMetrics[measurementType] = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{Name: c.Metric, Help: help},
+			[]string{"user"},
+		)
+		measureTypeIDs[measurementType] = id
+		measurementMetricNames[measurementType] = c.Metric
+		metricCollectors[c.Metric] = measurementType
+		measurementTypes = append(measurementTypes, measurementType)
+		collectors = append(collectors, measurementType)
+	}
+
+	return nil
+}
@@ -1,22 +1,646 @@
 package main
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"fmt"
+	"time"
 
-var currentWeightMetric = prometheus.NewGauge(
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Names of the metrics exposing each measurement type.
+var measurementMetricNames = map[string]string{
+	"weight":              "withings_current_weight",
+	"hydration":           "withings_current_hydration",
+	"fat_ratio":           "withings_fat_ratio_percent",
+	"fat_mass":            "withings_fat_mass_kg",
+	"fat_free_mass":       "withings_fat_free_mass_kg",
+	"muscle_mass":         "withings_muscle_mass_kg",
+	"bone_mass":           "withings_bone_mass_kg",
+	"heart_rate":          "withings_heart_rate_bpm",
+	"spo2":                "withings_spo2_percent",
+	"pulse_wave_velocity": "withings_pulse_wave_velocity_meters_per_second",
+	"vascular_age":        "withings_vascular_age_years",
+	"visceral_fat":        "withings_visceral_fat",
+	"vo2max":              "withings_vo2max",
+}
+
+var currentWeightMetric = prometheus.NewGaugeVec(
 	prometheus.GaugeOpts{
 		Name: "withings_current_weight",
 		Help: "Shows the latest weight measurement (in kg)",
 	},
+	[]string{"user"},
+)
+
+var weightChangeRateMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_weight_change_rate_kg_per_week",
+		Help: "Rate of weight change from a linear regression over the recent weight history",
+	},
+	[]string{"user"},
+)
+
+var weightTrend7dMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_weight_trend_7d_kg",
+		Help: "Average of the weight measurements of the last 7 days",
+	},
+	[]string{"user"},
+)
+
+var weightTrend30dMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_weight_trend_30d_kg",
+		Help: "Average of the weight measurements of the last 30 days",
+	},
+	[]string{"user"},
+)
+
+var weightChangeMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_weight_change_kg",
+		Help: "Difference between the latest and the previous weight measurement",
+	},
+	[]string{"user"},
 )
 
-var hydrationMetric = prometheus.NewGauge(
+var weightChangeIntervalMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_weight_change_interval_seconds",
+		Help: "Time between the latest and the previous weight measurement",
+	},
+	[]string{"user"},
+)
+
+var hydrationMetric = prometheus.NewGaugeVec(
 	prometheus.GaugeOpts{
 		Name: "withings_current_hydration",
 		Help: "Shows the latest hydration measurement (in kg)",
 	},
+	[]string{"user"},
+)
+
+// withings_hydration_kg is named like the other body composition metrics;
+// withings_current_hydration is kept for existing dashboards.
+var hydrationKgMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_hydration_kg",
+		Help: "Shows the latest hydration measurement",
+	},
+	[]string{"user"},
+)
+
+var bodyCompositionMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_body_composition_percent",
+		Help: "Body component (fat, muscle, bone or water) as a percentage of the latest weight",
+	},
+	[]string{"user", "component"},
+)
+
+var fatRatioMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_fat_ratio_percent",
+		Help: "Shows the latest body fat percentage measurement",
+	},
+	[]string{"user"},
+)
+
+var bmiMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_bmi",
+		Help: "Body mass index computed from the latest weight measurement and the account's height",
+	},
+	[]string{"user"},
+)
+
+var heartRateMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_heart_rate_bpm",
+		Help: "Shows the latest heart pulse measurement, e.g. from a scale (in beats per minute)",
+	},
+	[]string{"user"},
+)
+
+var spo2Metric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_spo2_percent",
+		Help: "Shows the latest blood oxygen saturation (SpO2) measurement",
+	},
+	[]string{"user"},
+)
+
+var pulseWaveVelocityMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_pulse_wave_velocity_meters_per_second",
+		Help: "Shows the latest pulse wave velocity measurement, e.g. from a Body Cardio scale",
+	},
+	[]string{"user"},
+)
+
+var vascularAgeMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_vascular_age_years",
+		Help: "Shows the vascular age estimated from the latest pulse wave velocity measurement",
+	},
+	[]string{"user"},
+)
+
+var vo2maxMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_vo2max",
+		Help: "Shows the latest VO2max estimate (in ml/min/kg)",
+	},
+	[]string{"user"},
+)
+
+var visceralFatMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_visceral_fat",
+		Help: "Shows the latest visceral fat index measurement",
+	},
+	[]string{"user"},
+)
+
+var bloodPressureSystolicMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_blood_pressure_systolic_mmhg",
+		Help: "Systolic pressure of the latest blood pressure measurement",
+	},
+	[]string{"user"},
+)
+
+var bloodPressureDiastolicMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_blood_pressure_diastolic_mmhg",
+		Help: "Diastolic pressure of the latest blood pressure measurement",
+	},
+	[]string{"user"},
+)
+
+var workoutDurationMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_last_workout_duration_seconds",
+		Help: "Effective duration of the latest workout of the category",
+	},
+	[]string{"user", "category"},
+)
+
+var workoutCaloriesMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_last_workout_calories",
+		Help: "Active calories burned in the latest workout of the category, in kcal",
+	},
+	[]string{"user", "category"},
+)
+
+var workoutDistanceMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_last_workout_distance_meters",
+		Help: "Distance covered in the latest workout of the category",
+	},
+	[]string{"user", "category"},
+)
+
+var workoutHeartRateMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_last_workout_heart_rate_average_bpm",
+		Help: "Average heart rate during the latest workout of the category",
+	},
+	[]string{"user", "category"},
+)
+
+var heartReadingHeartRateMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_heart_reading_heart_rate_bpm",
+		Help: "Heart rate of the latest blood pressure or ECG reading in the heart list",
+	},
+	[]string{"user"},
+)
+
+var heartReadingECGMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_heart_reading_ecg_available",
+		Help: "Whether the latest reading in the heart list has an ECG signal (1) or not (0)",
+	},
+	[]string{"user"},
+)
+
+var napCountMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_naps",
+		Help: "Number of daytime naps taken today",
+	},
+	[]string{"user"},
+)
+
+var napDurationMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_nap_duration_seconds",
+		Help: "Total duration of the daytime naps taken today",
+	},
+	[]string{"user"},
+)
+
+var afibLastDetectedMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_ecg_afib_last_detected_timestamp_seconds",
+		Help: "Time of the most recent ECG recording classified as atrial fibrillation",
+	},
+	[]string{"user"},
+)
+
+var rawMeasurementMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_raw_measurement",
+		Help: "Unscaled value of the latest measure of each Withings measure type; the real value is value * 10^unit",
+	},
+	[]string{"user", "type", "unit", "attrib"},
+)
+
+var devicesMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_devices",
+		Help: "Devices linked to the Withings account; always 1",
+	},
+	[]string{"user", "model", "type"},
+)
+
+var deviceBatteryMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_device_battery",
+		Help: "Battery level of the device: 1 (low), 2 (medium) or 3 (high)",
+	},
+	[]string{"user", "model", "deviceid"},
+)
+
+var deviceLastSessionMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_device_last_session_timestamp_seconds",
+		Help: "Time the device last synchronised with Withings",
+	},
+	[]string{"user", "model", "deviceid"},
+)
+
+var goalWeightMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_goal_weight_kg",
+		Help: "Weight goal set in the Withings app",
+	},
+	[]string{"user"},
+)
+
+var goalStepsMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_goal_steps",
+		Help: "Daily steps goal set in the Withings app",
+	},
+	[]string{"user"},
 )
 
-func registerMetrics() {
-	prometheus.MustRegister(currentWeightMetric)
-	prometheus.MustRegister(hydrationMetric)
+var goalSleepMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_goal_sleep_seconds",
+		Help: "Nightly sleep goal set in the Withings app",
+	},
+	[]string{"user"},
+)
+
+var goalWeightRemainingMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_goal_weight_remaining_kg",
+		Help: "Latest weight minus the weight goal; negative when below the goal",
+	},
+	[]string{"user"},
+)
+
+var goalStepsProgressMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_goal_steps_progress_ratio",
+		Help: "Steps taken today as a fraction of the daily steps goal",
+	},
+	[]string{"user"},
+)
+
+var objectiveMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_objective",
+		Help: "Latest objective of the measurement type entered in the Withings app",
+	},
+	[]string{"user", "type"},
+)
+
+var intradayStepsMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_intraday_steps",
+		Help: "Steps taken within the intraday window",
+	},
+	[]string{"user"},
+)
+
+var intradayCaloriesMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_intraday_calories",
+		Help: "Active calories burned within the intraday window, in kcal",
+	},
+	[]string{"user"},
+)
+
+var intradayHeartRateMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_intraday_heart_rate_bpm",
+		Help: "Latest heart rate within the intraday window",
+	},
+	[]string{"user"},
+)
+
+var intradayHeartRateAverageMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_intraday_heart_rate_average_bpm",
+		Help: "Average heart rate within the intraday window",
+	},
+	[]string{"user"},
+)
+
+// The intraday distributions are native histograms, which keep their
+// resolution in a handful of sparse buckets.
+var intradayHeartRateHistogram = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:                           "withings_intraday_heart_rate_distribution_bpm",
+		Help:                           "Distribution of the intraday heart rate samples",
+		NativeHistogramBucketFactor:    1.1,
+		NativeHistogramMaxBucketNumber: 100,
+	},
+	[]string{"user"},
+)
+
+var intradayStepsHistogram = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:                           "withings_intraday_steps_distribution",
+		Help:                           "Distribution of the steps of the intraday samples",
+		NativeHistogramBucketFactor:    1.1,
+		NativeHistogramMaxBucketNumber: 100,
+	},
+	[]string{"user"},
+)
+
+var anomalyMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_measurement_anomaly",
+		Help: "Whether the latest measurement failed the configured plausibility check (1) or not (0)",
+	},
+	[]string{"user", "type"},
+)
+
+var aggregateMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_aggregate",
+		Help: "Aggregate of the current week's or month's measurements from the history store",
+	},
+	[]string{"user", "type", "period", "stat"},
+)
+
+var collectorPausedMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_collector_paused",
+		Help: "Whether background polling of the collector is paused (1) or not (0)",
+	},
+	[]string{"collector"},
+)
+
+var upMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_up",
+		Help: "Whether the last refresh of every enabled collector succeeded (1) or not (0)",
+	},
+	[]string{"user"},
+)
+
+var collectorUpMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_collector_up",
+		Help: "Whether the last refresh of the collector succeeded (1) or not (0)",
+	},
+	[]string{"user", "collector"},
+)
+
+var authOKMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_auth_ok",
+		Help: "Whether the exporter holds working Withings API credentials (1) or the API rejected them and refreshing failed (0)",
+	},
+	[]string{"user"},
+)
+
+var tokenExpiryMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_oauth_token_expiry_timestamp_seconds",
+		Help: "Time the current Withings API access token expires",
+	},
+	[]string{"user"},
+)
+
+var tokenRefreshesMetric = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "withings_oauth_token_refreshes_total",
+		Help: "Number of successful Withings API access token refreshes",
+	},
+	[]string{"user"},
+)
+
+var tokenRefreshErrorsMetric = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "withings_oauth_token_refresh_errors_total",
+		Help: "Number of failed Withings API access token refreshes",
+	},
+	[]string{"user"},
+)
+
+var apiQuotaLimitMetric = prometheus.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Name: "withings_api_quota_limit",
+		Help: "Number of Withings API requests allowed per minute",
+	},
+	func() float64 { return float64(apiQuota.Limit()) },
+)
+
+var apiQuotaUsedMetric = prometheus.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Name: "withings_api_quota_used",
+		Help: "Number of Withings API requests made in the last minute",
+	},
+	func() float64 { return float64(apiQuota.Used(time.Now())) },
+)
+
+var apiQuotaRemainingMetric = prometheus.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Name: "withings_api_quota_remaining",
+		Help: "Estimated number of Withings API requests left in the current minute",
+	},
+	func() float64 { return float64(apiQuota.Remaining(time.Now())) },
+)
+
+var apiRateLimitedMetric = prometheus.NewCounterFunc(
+	prometheus.CounterOpts{
+		Name: "withings_api_rate_limited_total",
+		Help: "Number of Withings API requests rejected for exceeding the rate limit",
+	},
+	func() float64 { return float64(apiQuota.RateLimits()) },
+)
+
+var apiRequestsMetric = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "withings_api_requests_total",
+		Help: "Number of Withings API requests by endpoint and the status in the response body (error if there was no response)",
+	},
+	[]string{"endpoint", "status"},
+)
+
+var apiRequestDurationMetric = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "withings_api_request_duration_seconds",
+		Help:    "Duration of Withings API requests",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"endpoint"},
+)
+
+var apiErrorsMetric = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "withings_api_errors_total",
+		Help: "Number of failed Withings API requests",
+	},
+	[]string{"endpoint"},
+)
+
+var lastSuccessfulFetchMetric = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "withings_last_successful_fetch_timestamp_seconds",
+		Help: "Time of the last successful Withings API request for an account",
+	},
+	[]string{"user"},
+)
+
+// registerMetrics registers every metric, returning an error if a metric
+// named in the configuration file clashes with another one.
+func registerMetrics() error {
+	mustRegister(currentWeightMetric)
+	mustRegister(weightChangeRateMetric)
+	mustRegister(weightTrend7dMetric)
+	mustRegister(weightTrend30dMetric)
+	mustRegister(weightChangeMetric)
+	mustRegister(weightChangeIntervalMetric)
+	mustRegister(hydrationMetric)
+	mustRegister(hydrationKgMetric)
+	mustRegister(bmiMetric)
+	mustRegister(heartRateMetric)
+	mustRegister(spo2Metric)
+	mustRegister(pulseWaveVelocityMetric)
+	mustRegister(vascularAgeMetric)
+	mustRegister(visceralFatMetric)
+	mustRegister(vo2maxMetric)
+	mustRegister(bloodPressureSystolicMetric)
+	mustRegister(bloodPressureDiastolicMetric)
+	mustRegister(bodyCompositionMetric)
+	mustRegister(fatRatioMetric)
+	for _, gauge := range bodyCompositionMetrics {
+		mustRegister(gauge)
+	}
+	for _, metric := range sleepSummaryMetrics {
+		mustRegister(metric.gauge)
+	}
+	mustRegister(workoutDurationMetric)
+	mustRegister(workoutCaloriesMetric)
+	mustRegister(workoutDistanceMetric)
+	mustRegister(workoutHeartRateMetric)
+	mustRegister(workoutsCollector{})
+	mustRegister(napCountMetric)
+	mustRegister(napDurationMetric)
+	mustRegister(ecgRecordingsCollector{})
+	mustRegister(afibLastDetectedMetric)
+	mustRegister(heartReadingHeartRateMetric)
+	mustRegister(heartReadingECGMetric)
+	mustRegister(devicesMetric)
+	mustRegister(deviceBatteryMetric)
+	mustRegister(deviceLastSessionMetric)
+	mustRegister(goalWeightMetric)
+	mustRegister(goalStepsMetric)
+	mustRegister(goalSleepMetric)
+	mustRegister(goalWeightRemainingMetric)
+	mustRegister(goalStepsProgressMetric)
+	mustRegister(anomalyMetric)
+	if contains(collectors, "raw") {
+		mustRegister(rawMeasurementMetric)
+	}
+	if contains(collectors, "intraday") {
+		mustRegister(intradayStepsMetric)
+		mustRegister(intradayCaloriesMetric)
+		mustRegister(intradayHeartRateMetric)
+		mustRegister(intradayHeartRateAverageMetric)
+		if intradayHistograms {
+			mustRegister(intradayHeartRateHistogram)
+			mustRegister(intradayStepsHistogram)
+		}
+	}
+	if contains(collectors, "objectives") {
+		mustRegister(objectiveMetric)
+	}
+	if contains(collectors, "bodyscan") {
+		for _, gauge := range bodyScanWaterMetrics {
+			mustRegister(gauge)
+		}
+		for _, gauge := range bodyScanSegmentMetrics {
+			mustRegister(gauge)
+		}
+	}
+	mustRegister(daysSinceCollector{})
+	mustRegister(activityCollector{})
+	for _, gauge := range dailyActivityGauges {
+		mustRegister(gauge.vec)
+	}
+	mustRegister(aggregateMetric)
+	mustRegister(collectorPausedMetric)
+	mustRegister(upMetric)
+	if perCollectorUp {
+		mustRegister(collectorUpMetric)
+	}
+	mustRegister(authOKMetric)
+	mustRegister(tokenExpiryMetric)
+	mustRegister(tokenRefreshesMetric)
+	mustRegister(tokenRefreshErrorsMetric)
+	mustRegister(apiRequestsMetric)
+	mustRegister(apiRequestDurationMetric)
+	mustRegister(apiErrorsMetric)
+	mustRegister(lastSuccessfulFetchMetric)
+	mustRegister(apiQuotaLimitMetric)
+	mustRegister(apiQuotaUsedMetric)
+	mustRegister(apiQuotaRemainingMetric)
+	mustRegister(apiRateLimitedMetric)
+	updatePausedMetric()
+	for _, gauge := range temperatureMetrics {
+		mustRegister(gauge)
+	}
+	for _, gauges := range dualUnitGauges {
+		for _, gauge := range gauges {
+			mustRegister(gauge)
+		}
+	}
+	for _, gauge := range workoutDistanceGauges {
+		mustRegister(gauge)
+	}
+
+	// Metrics named in the configuration file come last, so that clashes
+	// with built-in metrics are reported against them.
+	for measurementType, gauge := range configuredMeasureMetrics {
+		if err := register(gauge); err != nil {
+			return fmt.Errorf("measure type metric %s clashes with another metric", measurementMetricNames[measurementType])
+		}
+	}
+	for _, metric := range derivedMetrics {
+		if err := register(metric.gauge); err != nil {
+			return fmt.Errorf("derived metric withings_%s clashes with another metric", metric.name)
+		}
+	}
+
+	return validateRenameTargets()
 }
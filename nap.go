@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// isNap reports whether a sleep session from start to end is a daytime nap
+// rather than nighttime sleep. Withings does not distinguish the two, so
+// short sessions that start during the day count as naps.
+func isNap(start time.Time, end time.Time) bool {
+	maxDuration := 4 * time.Hour
+	if config.Sleep.NapMaxDuration > 0 {
+		maxDuration = config.Sleep.NapMaxDuration
+	}
+	dayStart, dayEnd := 8, 20
+	if config.Sleep.DayStartHour != nil {
+		dayStart = *config.Sleep.DayStartHour
+	}
+	if config.Sleep.DayEndHour != nil {
+		dayEnd = *config.Sleep.DayEndHour
+	}
+
+	return end.Sub(start) <= maxDuration && start.Hour() >= dayStart && start.Hour() < dayEnd
+}
+
+// sessionLocation returns the location of a sleep session's timezone, or the
+// local timezone if it is unknown.
+func sessionLocation(timezone string) *time.Location {
+	if loc, err := time.LoadLocation(timezone); err == nil && timezone != "" {
+		return loc
+	}
+	return time.Local
+}
+
+// updateSleepMetrics refreshes the metrics derived from last night's and
+// today's sleep sessions, and records the time asleep of each night in store
+// if it is not nil.
+func updateSleepMetrics(ctx context.Context, accessToken string, store *HistoryStore) {
+	now := time.Now()
+	summaries, err := getSleepSummaries(ctx, accessToken, now.AddDate(0, 0, -1), now)
+	if err != nil {
+		log.Printf("Cannot fetch sleep summaries: %v", err)
+		return
+	}
+
+	updateSleepSummaryMetrics(ctx, summaries)
+
+	today := now.Format("2006-01-02")
+	naps := 0
+	var napDuration time.Duration
+	var samples []Sample
+	for _, summary := range summaries.Body.Series {
+		loc := sessionLocation(summary.Timezone)
+		start := time.Unix(summary.StartDate, 0).In(loc)
+		end := time.Unix(summary.EndDate, 0).In(loc)
+		if !isNap(start, end) {
+			if asleep, ok := summary.Data["total_sleep_time"]; ok {
+				samples = append(samples, Sample{User: contextUser(ctx), Type: "sleep_duration", Time: end, Value: asleep})
+			}
+			continue
+		}
+		if start.Format("2006-01-02") != today {
+			continue
+		}
+
+		naps++
+		napDuration += end.Sub(start)
+	}
+
+	log.Printf("Setting withings_naps metric to %d (%s).\n", naps, napDuration)
+	napCountMetric.WithLabelValues(contextUser(ctx)).Set(float64(naps))
+	napDurationMetric.WithLabelValues(contextUser(ctx)).Set(napDuration.Seconds())
+
+	if store != nil {
+		if err := store.Add(samples...); err != nil {
+			log.Printf("Cannot update history store: %v", err)
+		}
+		updateAggregateMetrics(store, contextUser(ctx))
+	}
+}
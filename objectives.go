@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+)
+
+// Categories of measure groups: real measurements and objectives (goals
+// entered in the app). The measurement collectors only fetch real
+// measurements.
+const (
+	measureCategoryReal      = 1
+	measureCategoryObjective = 2
+)
+
+// updateObjectiveMetrics exposes the latest objective of every measurement
+// type as withings_objective.
+func updateObjectiveMetrics(ctx context.Context, accessToken string) {
+	measurementTypeNames := map[int]string{}
+	for name, id := range measureTypeIDs {
+		measurementTypeNames[id] = name
+	}
+
+	type objective struct {
+		date  int64
+		value float64
+	}
+	latest := map[string]objective{}
+
+	offset := 0
+	for {
+		url := fmt.Sprintf("%s/measure?action=getmeas&category=%d", withingsAPIBaseURL, measureCategoryObjective)
+		if offset > 0 {
+			url += fmt.Sprintf("&offset=%d", offset)
+		}
+
+		body, err := withingsRequest(ctx, url, accessToken)
+		if err != nil {
+			log.Printf("Cannot fetch objectives: %v", err)
+			return
+		}
+
+		parsedMeasures := Measures{}
+		if err := json.Unmarshal(body, &parsedMeasures); err != nil {
+			log.Printf("Cannot parse objectives: %v", err)
+			return
+		}
+
+		for _, group := range parsedMeasures.Body.MeasureGroups {
+			for _, measure := range group.Measures {
+				name, ok := measurementTypeNames[measure.Type]
+				if !ok {
+					continue
+				}
+				if existing, ok := latest[name]; ok && existing.date >= group.Date {
+					continue
+				}
+				latest[name] = objective{group.Date, measure.Value * math.Pow10(measure.Unit)}
+			}
+		}
+
+		if parsedMeasures.Body.More == 0 || parsedMeasures.Body.Offset <= offset {
+			break
+		}
+		offset = parsedMeasures.Body.Offset
+	}
+
+	user := contextUser(ctx)
+	deleteUserSeries(objectiveMetric, user)
+	for measurementType, objective := range latest {
+		objectiveMetric.WithLabelValues(user, measurementType).Set(math.Round(objective.value*10) / 10)
+	}
+	log.Printf("Setting withings_objective metric for %d measurement types.\n", len(latest))
+}
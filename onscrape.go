@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// scrapeRefresher refreshes the collectors when /metrics is scraped, unless
+// they were refreshed less than maxAge ago. It is set with
+// --collect-on-scrape.
+type scrapeRefresher struct {
+	mu      sync.Mutex
+	maxAge  time.Duration
+	last    time.Time
+	refresh func(ctx context.Context)
+	// Closed when the running refresh finishes; nil if none is running.
+	done chan struct{}
+}
+
+var onScrape *scrapeRefresher
+
+// Refresh runs the refresh if the data is older than maxAge, and waits for
+// it until ctx is done. Concurrent scrapes wait for a running refresh rather
+// than starting another one. The refresh has the deadline of ctx, so its
+// upstream requests are cancelled when the scrape has to be served; a
+// cancelled refresh leaves the data stale, so the next scrape retries.
+func (s *scrapeRefresher) Refresh(ctx context.Context) {
+	s.mu.Lock()
+	if time.Since(s.last) < s.maxAge {
+		s.mu.Unlock()
+		return
+	}
+	done := s.done
+	if done == nil {
+		log.Println("Updating data for scrape...")
+		done = make(chan struct{})
+		s.done = done
+		// Concurrent scrapes share the refresh, so it does not end when the
+		// scrape that started it goes away before its deadline.
+		refreshCtx, cancel := context.WithoutCancel(ctx), context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			refreshCtx, cancel = context.WithDeadline(refreshCtx, deadline)
+		}
+		go func() {
+			defer cancel()
+			s.refresh(refreshCtx)
+			s.mu.Lock()
+			if refreshCtx.Err() == nil {
+				s.last = time.Now()
+			}
+			s.done = nil
+			s.mu.Unlock()
+			close(done)
+		}()
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("Scrape timed out; serving the data collected so far.")
+	}
+}
+
+// Wait waits for the running refresh, if any, e.g. before exiting.
+func (s *scrapeRefresher) Wait() {
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// scrapeContext returns the context of a scrape, which Prometheus gives up
+// on after the timeout in its X-Prometheus-Scrape-Timeout-Seconds header. It
+// ends a tenth of the timeout, at most a second, early, leaving time to
+// render and send the metrics.
+func scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	seconds, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil {
+		return context.WithCancel(r.Context())
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	return context.WithTimeout(r.Context(), timeout-min(timeout/10, time.Second))
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// The OpenAPI document describing the exporter's HTTP endpoints. Keep it in
+// sync when adding or changing endpoints.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// pauseState records whether background polling is paused, either for every
+// collector or for individual ones.
+type pauseState struct {
+	mu         sync.Mutex
+	all        bool
+	collectors map[string]bool
+}
+
+var polling = &pauseState{collectors: map[string]bool{}}
+
+// Pause stops polling of the named collector, or of every collector if name
+// is empty.
+func (p *pauseState) Pause(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if name == "" {
+		p.all = true
+	} else {
+		p.collectors[name] = true
+	}
+}
+
+// Resume undoes Pause. Resuming every collector also clears individual
+// pauses.
+func (p *pauseState) Resume(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if name == "" {
+		p.all = false
+		p.collectors = map[string]bool{}
+	} else {
+		delete(p.collectors, name)
+	}
+}
+
+// Paused reports whether the named collector is paused.
+func (p *pauseState) Paused(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.all || p.collectors[name]
+}
+
+// Active returns the names that are not paused.
+func (p *pauseState) Active(names []string) []string {
+	var active []string
+	for _, name := range names {
+		if !p.Paused(name) {
+			active = append(active, name)
+		}
+	}
+	return active
+}
+
+// pauseHandler pauses (or, with pause false, resumes) polling. The collector
+// query parameter restricts the change to one collector.
+func pauseHandler(pause bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := r.URL.Query().Get("collector")
+		if name != "" && !contains(collectors, name) {
+			http.Error(w, fmt.Sprintf("unknown collector %q", name), http.StatusBadRequest)
+			return
+		}
+
+		if pause {
+			polling.Pause(name)
+		} else {
+			polling.Resume(name)
+		}
+		updatePausedMetric()
+
+		for _, name := range collectors {
+			state := "polling"
+			if polling.Paused(name) {
+				state = "paused"
+			}
+			fmt.Fprintf(w, "%s: %s\n", name, state)
+		}
+	})
+}
+
+func updatePausedMetric() {
+	for _, name := range collectors {
+		value := 0.0
+		if polling.Paused(name) {
+			value = 1
+		}
+		collectorPausedMetric.WithLabelValues(name).Set(value)
+	}
+}
+
+// requestPause asks the exporter at baseURL to pause or resume polling.
+func requestPause(baseURL string, pause bool, collector string) error {
+	path := "/-/resume"
+	if pause {
+		path = "/-/pause"
+	}
+
+	u := strings.TrimSuffix(baseURL, "/") + path
+	if collector != "" {
+		u += "?collector=" + url.QueryEscape(collector)
+	}
+
+	resp, err := http.Post(u, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	fmt.Print(string(body))
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// probeHandler serves /probe?user=alice&collectors=weight,sleep, refreshing
+// the given collectors of one account on demand and returning only their
+// metrics, like blackbox_exporter's multi-target pattern. Without
+// collectors, every collector is refreshed.
+func probeHandler(accounts *accountSet, store *HistoryStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		user := query.Get("user")
+		if user == "" {
+			user = primaryUser
+		}
+		var tokens *tokenSource
+		for _, a := range accounts.List() {
+			if a.name == user {
+				tokens = a.tokens
+			}
+		}
+		if tokens == nil {
+			http.Error(w, fmt.Sprintf("unknown user %q", user), http.StatusNotFound)
+			return
+		}
+
+		names := collectors
+		if value := query.Get("collectors"); value != "" {
+			names = strings.Split(value, ",")
+			for _, name := range names {
+				if !contains(collectors, name) {
+					http.Error(w, fmt.Sprintf("unknown collector %q", name), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		// Finish before Prometheus gives up on the scrape.
+		ctx, cancel := scrapeContext(r)
+		defer cancel()
+
+		ctx = withUser(ctx, user)
+		ctx, span := tracer.Start(ctx, "probe")
+		start := time.Now()
+		failures := failedRequests()
+		updateCollectors(ctx, tokens.Token(ctx), store, names)
+		span.End()
+
+		registry := prometheus.NewRegistry()
+		successMetric := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "withings_probe_success",
+			Help: "Whether every Withings API request of the probe succeeded (1) or not (0)",
+		})
+		durationMetric := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "withings_probe_duration_seconds",
+			Help: "How long the probe took",
+		})
+		registry.MustRegister(successMetric, durationMetric)
+		successMetric.Set(boolValue(failedRequests() == failures))
+		durationMetric.Set(time.Since(start).Seconds())
+
+		gatherer := prometheus.Gatherers{
+			registry,
+			collectorGatherer{userGatherer{cardinalityGuard{prometheus.DefaultGatherer}, user}, names},
+		}
+		metricsHandlerFor(gatherer).ServeHTTP(w, r)
+	})
+}
+
+// sdTarget is a target group of Prometheus' HTTP service discovery.
+// https://prometheus.io/docs/prometheus/latest/http_sd/
+type sdTarget struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// sdHandler serves /sd, listing a /probe target per configured account at
+// the address the exporter was reached on.
+func sdHandler(w http.ResponseWriter, r *http.Request) {
+	targets := []sdTarget{}
+	for _, name := range configuredAccounts() {
+		targets = append(targets, sdTarget{
+			Targets: []string{r.Host},
+			Labels: map[string]string{
+				"__metrics_path__": "/probe",
+				"__param_user":     name,
+				"instance":         name,
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targets)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// pushSample is a single series value gathered from a registry, ready to be
+// pushed somewhere.
+type pushSample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// pushTarget describes where pushMetrics sends samples. Empty fields disable
+// the corresponding destination.
+type pushTarget struct {
+	remoteWriteURL      string
+	remoteWriteUsername string
+	remoteWritePassword string
+	cloudWatchNamespace string
+}
+
+// pushGatherer returns the gatherer of the metrics to push, in the units
+// they are exposed in.
+func pushGatherer() prometheus.Gatherer {
+	var gatherer prometheus.Gatherer = cardinalityGuard{prometheus.DefaultGatherer}
+	if imperialUnits {
+		gatherer = imperialGatherer{gatherer}
+	}
+	return gatherer
+}
+
+// gatherPushSamples returns the current value of every withings_ gauge and
+// counter in gatherer, under its configured name.
+func gatherPushSamples(gatherer prometheus.Gatherer) ([]pushSample, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []pushSample
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "withings_") {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			sample := pushSample{Name: renamedMetric(family.GetName()), Labels: map[string]string{}}
+			for _, label := range metric.GetLabel() {
+				sample.Labels[label.GetName()] = label.GetValue()
+			}
+
+			switch {
+			case metric.Gauge != nil:
+				sample.Value = metric.GetGauge().GetValue()
+			case metric.Counter != nil:
+				sample.Value = metric.GetCounter().GetValue()
+			case metric.Untyped != nil:
+				sample.Value = metric.GetUntyped().GetValue()
+			default:
+				continue
+			}
+
+			samples = append(samples, sample)
+		}
+	}
+
+	return samples, nil
+}
+
+// pushMetrics sends samples, all stamped with t, to every configured target.
+func pushMetrics(ctx context.Context, target pushTarget, samples []pushSample, t time.Time) error {
+	if target.remoteWriteURL != "" {
+		if err := pushRemoteWrite(ctx, target, samples, t); err != nil {
+			return fmt.Errorf("remote write: %v", err)
+		}
+	}
+
+	if target.cloudWatchNamespace != "" {
+		if err := writeEmbeddedMetrics(os.Stdout, target.cloudWatchNamespace, samples, t); err != nil {
+			return fmt.Errorf("cloudwatch: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// pushRemoteWrite sends samples to a Prometheus remote_write endpoint.
+// https://prometheus.io/docs/concepts/remote_write_spec/
+func pushRemoteWrite(ctx context.Context, target pushTarget, samples []pushSample, t time.Time) error {
+	var series []remoteWriteSeries
+	for _, sample := range samples {
+		series = append(series, remoteWriteSeries{
+			Labels:  remoteWriteLabels(sample.Name, sample.Labels),
+			Samples: []remoteWriteSample{{Value: sample.Value, Timestamp: t}},
+		})
+	}
+
+	return sendRemoteWrite(ctx, target, series)
+}
+
+type remoteWriteSample struct {
+	Value     float64
+	Timestamp time.Time
+}
+
+type remoteWriteSeries struct {
+	// Labels must be sorted by name and include __name__.
+	Labels  [][2]string
+	Samples []remoteWriteSample
+}
+
+func remoteWriteLabels(name string, labels map[string]string) [][2]string {
+	result := [][2]string{{"__name__", name}}
+	for k, v := range labels {
+		result = append(result, [2]string{k, v})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i][0] < result[j][0] })
+
+	return result
+}
+
+// encodeWriteRequest encodes series as a prometheus.WriteRequest protobuf
+// message.
+func encodeWriteRequest(series []remoteWriteSeries) []byte {
+	var request []byte
+	for _, s := range series {
+		var ts []byte
+		for _, label := range s.Labels {
+			var l []byte
+			l = protowire.AppendTag(l, 1, protowire.BytesType)
+			l = protowire.AppendString(l, label[0])
+			l = protowire.AppendTag(l, 2, protowire.BytesType)
+			l = protowire.AppendString(l, label[1])
+
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, l)
+		}
+		for _, sample := range s.Samples {
+			var sm []byte
+			sm = protowire.AppendTag(sm, 1, protowire.Fixed64Type)
+			sm = protowire.AppendFixed64(sm, math.Float64bits(sample.Value))
+			sm = protowire.AppendTag(sm, 2, protowire.VarintType)
+			sm = protowire.AppendVarint(sm, uint64(sample.Timestamp.UnixNano()/int64(time.Millisecond)))
+
+			ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, sm)
+		}
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, ts)
+	}
+
+	return request
+}
+
+func sendRemoteWrite(ctx context.Context, target pushTarget, series []remoteWriteSeries) error {
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", target.remoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if target.remoteWriteUsername != "" {
+		req.SetBasicAuth(target.remoteWriteUsername, target.remoteWritePassword)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(message)))
+	}
+
+	return nil
+}
+
+// writeEmbeddedMetrics writes samples to w in CloudWatch's embedded metric
+// format, one log line per sample with its labels as dimensions. In Lambda,
+// anything written to standard output ends up in CloudWatch Logs, which
+// extracts the metrics.
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+func writeEmbeddedMetrics(w io.Writer, namespace string, samples []pushSample, t time.Time) error {
+	encoder := json.NewEncoder(w)
+	for _, sample := range samples {
+		dimensions := []string{}
+		line := map[string]interface{}{sample.Name: sample.Value}
+		for k, v := range sample.Labels {
+			dimensions = append(dimensions, k)
+			line[k] = v
+		}
+		sort.Strings(dimensions)
+
+		line["_aws"] = map[string]interface{}{
+			"Timestamp": t.UnixNano() / int64(time.Millisecond),
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  namespace,
+				"Dimensions": [][]string{dimensions},
+				"Metrics":    []map[string]string{{"Name": sample.Name}},
+			}},
+		}
+
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
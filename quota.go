@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Withings allows 120 requests per minute per application by default.
+var apiQuota = NewQuotaTracker(time.Minute, 120)
+
+// QuotaTracker estimates how much of the Withings API quota is left by
+// counting requests over a sliding window. Rate-limit headers and rate-limit
+// responses from the API override the estimate until the window has passed.
+type QuotaTracker struct {
+	mu          sync.Mutex
+	window      time.Duration
+	limit       int
+	requests    []time.Time
+	reported    int
+	reportedAt  time.Time
+	rateLimits  int
+	hasReported bool
+}
+
+// NewQuotaTracker creates a tracker allowing limit requests per window.
+func NewQuotaTracker(window time.Duration, limit int) *QuotaTracker {
+	return &QuotaTracker{window: window, limit: limit}
+}
+
+// SetLimit changes the number of requests allowed per window.
+func (q *QuotaTracker) SetLimit(limit int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.limit = limit
+}
+
+// Limit returns the number of requests allowed per window.
+func (q *QuotaTracker) Limit() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.limit
+}
+
+// Record accounts for a request made at now.
+func (q *QuotaTracker) Record(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire(now)
+	q.requests = append(q.requests, now)
+}
+
+// ReportRemaining records the remaining quota as reported by the API.
+func (q *QuotaTracker) ReportRemaining(now time.Time, remaining int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.reported = remaining
+	q.reportedAt = now
+	q.hasReported = true
+}
+
+// RateLimited records that the API rejected a request for exceeding the quota.
+func (q *QuotaTracker) RateLimited(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rateLimits++
+	q.reported = 0
+	q.reportedAt = now
+	q.hasReported = true
+}
+
+// Used returns the number of requests made within the current window.
+func (q *QuotaTracker) Used(now time.Time) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire(now)
+	return len(q.requests)
+}
+
+// Remaining returns the estimated number of requests left in the window.
+func (q *QuotaTracker) Remaining(now time.Time) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire(now)
+	if q.hasReported && now.Sub(q.reportedAt) < q.window {
+		return q.reported
+	}
+
+	remaining := q.limit - len(q.requests)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// RateLimits returns how often the API has rejected requests for exceeding
+// the quota.
+func (q *QuotaTracker) RateLimits() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.rateLimits
+}
+
+func (q *QuotaTracker) expire(now time.Time) {
+	i := 0
+	for i < len(q.requests) && now.Sub(q.requests[i]) >= q.window {
+		i++
+	}
+	q.requests = q.requests[i:]
+}
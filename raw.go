@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// How far back the raw collector looks for the latest value of each type.
+const rawMeasurementWindow = 30 * 24 * time.Hour
+
+// updateRawMetrics exposes the latest unscaled value of every measure type
+// in the account, including types the exporter has no metric for.
+func updateRawMetrics(ctx context.Context, accessToken string) {
+	type rawMeasure struct {
+		date   int64
+		value  float64
+		unit   int
+		attrib int
+	}
+	latest := map[int]rawMeasure{}
+
+	offset := 0
+	for {
+		url := fmt.Sprintf("%s/measure?action=getmeas&category=%d&startdate=%d", withingsAPIBaseURL, measureCategoryReal, time.Now().Add(-rawMeasurementWindow).Unix())
+		if offset > 0 {
+			url += fmt.Sprintf("&offset=%d", offset)
+		}
+
+		body, err := withingsRequest(ctx, url, accessToken)
+		if err != nil {
+			log.Printf("Cannot fetch raw measurements: %v", err)
+			return
+		}
+
+		parsedMeasures := Measures{}
+		if err := json.Unmarshal(body, &parsedMeasures); err != nil {
+			log.Printf("Cannot parse raw measurements: %v", err)
+			return
+		}
+
+		for _, group := range parsedMeasures.Body.MeasureGroups {
+			for _, measure := range group.Measures {
+				if existing, ok := latest[measure.Type]; ok && existing.date >= group.Date {
+					continue
+				}
+				latest[measure.Type] = rawMeasure{date: group.Date, value: measure.Value, unit: measure.Unit, attrib: group.Attrib}
+			}
+		}
+
+		if parsedMeasures.Body.More == 0 || parsedMeasures.Body.Offset <= offset {
+			break
+		}
+		offset = parsedMeasures.Body.Offset
+	}
+
+	user := contextUser(ctx)
+	deleteUserSeries(rawMeasurementMetric, user)
+	for measureType, measure := range latest {
+		rawMeasurementMetric.WithLabelValues(user, strconv.Itoa(measureType), strconv.Itoa(measure.unit), strconv.Itoa(measure.attrib)).Set(measure.value)
+	}
+	log.Printf("Setting withings_raw_measurement metric for %d measure types.\n", len(latest))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Query parameters that are never written to recordings.
+var secretParams = []string{"client_id", "client_secret", "refresh_token", "code", "access_token", "signature", "nonce"}
+
+// Response body fields holding secrets, replaced in recordings.
+var secretFieldPattern = regexp.MustCompile(`"(access_token|refresh_token|csrf_token|userid)"\s*:\s*("[^"]*"|[0-9]+)`)
+
+const redacted = "REDACTED"
+
+// recording is an upstream request and its response, as stored on disk.
+type recording struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// strippedURL returns u without secret query parameters.
+func strippedURL(u *url.URL) string {
+	stripped := *u
+	query := stripped.Query()
+	for _, param := range secretParams {
+		if query.Get(param) != "" {
+			query.Set(param, redacted)
+		}
+	}
+	stripped.RawQuery = query.Encode()
+	return stripped.String()
+}
+
+// recordingPath returns the file a request is recorded in: a directory per
+// endpoint and action, and a file per distinct request.
+func recordingPath(dir string, req *http.Request) string {
+	endpoint := strings.Trim(req.URL.Path, "/")
+	if action := req.URL.Query().Get("action"); action != "" {
+		endpoint += "_" + action
+	}
+	endpoint = strings.ReplaceAll(endpoint, "/", "_")
+	if endpoint == "" {
+		endpoint = "root"
+	}
+
+	hash := sha256.Sum256([]byte(req.Method + " " + strippedURL(req.URL)))
+	return filepath.Join(dir, endpoint, fmt.Sprintf("%x.json", hash[:8]))
+}
+
+// recordingTransport writes every request and response passing through it
+// to dir, with secrets stripped.
+type recordingTransport struct {
+	next http.RoundTripper
+	dir  string
+}
+
+func (t recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	header := res.Header.Clone()
+	header.Del("Set-Cookie")
+	rec := recording{
+		Method: req.Method,
+		URL:    strippedURL(req.URL),
+		Status: res.StatusCode,
+		Header: header,
+		Body:   secretFieldPattern.ReplaceAllString(string(body), `"$1":"`+redacted+`"`),
+	}
+	if err := writeRecording(recordingPath(t.dir, req), rec); err != nil {
+		log.Printf("Cannot record API response: %v", err)
+	}
+
+	return res, nil
+}
+
+func writeRecording(path string, rec recording) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// replayTransport answers requests from the recordings in dir instead of
+// contacting the API. Requests that were not recorded exactly, e.g. because
+// they cover a different date range, get the most recent recording of the
+// same endpoint and action.
+type replayTransport struct {
+	dir string
+}
+
+func (t replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := recordingPath(t.dir, req)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		path, err = latestRecording(filepath.Dir(path))
+		if err == nil {
+			data, err = ioutil.ReadFile(path)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no recording of %s %s: %v", req.Method, strippedURL(req.URL), err)
+	}
+
+	rec := recording{}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.Status, http.StatusText(rec.Status)),
+		StatusCode:    rec.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.Header,
+		Body:          ioutil.NopCloser(strings.NewReader(rec.Body)),
+		ContentLength: int64(len(rec.Body)),
+		Request:       req,
+	}, nil
+}
+
+func latestRecording(dir string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	latest := ""
+	var latestInfo os.FileInfo
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		if latestInfo == nil || file.ModTime().After(latestInfo.ModTime()) {
+			latest, latestInfo = filepath.Join(dir, file.Name()), file
+		}
+	}
+	if latest == "" {
+		return "", os.ErrNotExist
+	}
+
+	return latest, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// accountSet holds the accounts the exporter collects metrics for, which
+// reloading the configuration file changes.
+type accountSet struct {
+	mu       sync.Mutex
+	accounts []account
+}
+
+// List returns the current accounts.
+func (s *accountSet) List() []account {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accounts
+}
+
+// Set replaces the accounts.
+func (s *accountSet) Set(accounts []account) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accounts = accounts
+}
+
+// accountReloader applies the accounts of the configuration file to a
+// running exporter. Other settings only take effect on restart.
+type accountReloader struct {
+	mu           sync.Mutex
+	path         string
+	clientID     string
+	clientSecret string
+	refreshToken string
+	tokenFile    string
+	accounts     *accountSet
+	store        *HistoryStore
+}
+
+// Reload rereads the configuration file, obtains tokens for added accounts
+// and collects their metrics, and removes the series of removed accounts.
+// The primary account cannot change, as history store samples recorded
+// without a user belong to it.
+func (r *accountReloader) Reload(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.path == "" {
+		return errors.New("no configuration file to reload")
+	}
+	c, err := loadConfig(r.path)
+	if err != nil {
+		return err
+	}
+	names, err := validateAccounts(c.Accounts)
+	if err != nil {
+		return err
+	}
+	if names[0] != primaryUser {
+		return fmt.Errorf("the first account must stay %s; restart the exporter to change it", primaryUser)
+	}
+
+	current := map[string]account{}
+	for _, a := range r.accounts.List() {
+		current[a.name] = a
+	}
+
+	accountsMu.Lock()
+	previous := config.Accounts
+	config.Accounts = c.Accounts
+	accountsMu.Unlock()
+
+	var accounts, added []account
+	for _, name := range names {
+		if a, ok := current[name]; ok {
+			accounts = append(accounts, a)
+			delete(current, name)
+			continue
+		}
+		tokens, err := newAccountTokenSource(r.clientID, r.clientSecret, name, r.refreshToken, r.tokenFile)
+		if err != nil {
+			accountsMu.Lock()
+			config.Accounts = previous
+			accountsMu.Unlock()
+			return err
+		}
+		added = append(added, account{name: name, tokens: tokens})
+		accounts = append(accounts, added[len(added)-1])
+	}
+
+	accountsMu.Lock()
+	accountNames = names
+	accountsMu.Unlock()
+	r.accounts.Set(accounts)
+
+	for name, a := range current {
+		log.Printf("Removing account %s.", name)
+		a.tokens.Flush()
+		deleteUser(name)
+	}
+	for _, a := range added {
+		log.Printf("Adding account %s.", a.name)
+	}
+	updateAccounts(ctx, added, r.store, collectors)
+	return nil
+}
+
+// reloadHandler reloads the configuration file on POST.
+func reloadHandler(reloader *accountReloader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := reloader.Reload(r.Context()); err != nil {
+			http.Error(w, fmt.Sprintf("cannot reload configuration file: %v", err), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "Reloaded accounts.")
+	})
+}
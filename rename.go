@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// MetricOverride replaces the name and/or help text of an exported metric.
+type MetricOverride struct {
+	Name string `yaml:"name"`
+	Help string `yaml:"help"`
+}
+
+// validateMetricOverrides checks that every renamed metric gets a valid and
+// unique name.
+func validateMetricOverrides(overrides map[string]MetricOverride) error {
+	names := map[string]string{}
+	for original, override := range overrides {
+		if override.Name == "" {
+			continue
+		}
+		if !model.IsValidMetricName(model.LabelValue(override.Name)) {
+			return fmt.Errorf("metric %s: invalid name %q", original, override.Name)
+		}
+		if other, ok := names[override.Name]; ok {
+			return fmt.Errorf("metrics %s and %s are both renamed to %s", other, original, override.Name)
+		}
+		names[override.Name] = original
+	}
+
+	return nil
+}
+
+// registeredMetricNames holds the names of the metrics registered with
+// register.
+var registeredMetricNames = map[string]bool{}
+
+var descNamePattern = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+// recordMetricNames adds the names of the metrics of c to
+// registeredMetricNames.
+func recordMetricNames(c prometheus.Collector) {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(ch)
+		close(ch)
+	}()
+	for desc := range ch {
+		// Desc has no accessor for the name.
+		if m := descNamePattern.FindStringSubmatch(desc.String()); m != nil {
+			registeredMetricNames[m[1]] = true
+		}
+	}
+}
+
+// validateRenameTargets checks that no metric is renamed to the name of
+// another registered metric, unless that one is renamed as well.
+func validateRenameTargets() error {
+	names := map[string]bool{}
+	for name := range registeredMetricNames {
+		names[name] = true
+		if imperial, _, ok := imperialMetricName(name); ok && imperialUnits {
+			names[imperial] = true
+		}
+	}
+	// The Go and process metrics.
+	families, _ := prometheus.DefaultGatherer.Gather()
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+
+	for original, override := range config.Metrics {
+		if override.Name == "" || override.Name == original || !names[override.Name] {
+			continue
+		}
+		if imperial, _, ok := imperialMetricName(original); ok && imperialUnits && imperial == override.Name {
+			continue
+		}
+		if other, ok := config.Metrics[override.Name]; ok && other.Name != "" && other.Name != override.Name {
+			continue
+		}
+		return fmt.Errorf("metric %s: cannot be renamed to %s, the name of another metric", original, override.Name)
+	}
+
+	return nil
+}
+
+// metricOverride returns the override of the named metric. With
+// --units=imperial, overrides remain keyed by the metric name, e.g.
+// withings_current_weight rather than withings_current_weight_lb.
+func metricOverride(name string) (MetricOverride, bool) {
+	if override, ok := config.Metrics[name]; ok {
+		return override, true
+	}
+	if imperialUnits {
+		for original, override := range config.Metrics {
+			if imperial, _, ok := imperialMetricName(original); ok && imperial == name {
+				return override, true
+			}
+		}
+	}
+	return MetricOverride{}, false
+}
+
+// renamedMetric returns the name a metric is exposed under.
+func renamedMetric(name string) string {
+	if override, ok := metricOverride(name); ok && override.Name != "" {
+		return override.Name
+	}
+	return name
+}
+
+// renamingGatherer applies the configured metric overrides to the families
+// returned by another gatherer.
+type renamingGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g renamingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+
+	for _, family := range families {
+		override, ok := metricOverride(family.GetName())
+		if !ok {
+			continue
+		}
+		if override.Name != "" {
+			family.Name = &override.Name
+		}
+		if override.Help != "" {
+			family.Help = &override.Help
+		}
+	}
+
+	return families, err
+}
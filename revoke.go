@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// revoke de-authorizes the exporter: it revokes the access grant of the
+// account whose tokens are in store (or of refreshToken) with the Withings
+// API, then deletes the stored tokens.
+func revoke(ctx context.Context, clientID string, clientSecret string, refreshToken string, store tokenStore) error {
+	if store != nil {
+		state, err := store.Load()
+		if err == nil {
+			refreshToken = state.RefreshToken
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if refreshToken == "" {
+		return errors.New("no tokens to revoke")
+	}
+
+	// Revocation needs the user ID, which comes with every new token.
+	body, err := withingsRequest(ctx, refreshTokenURL(withingsAPIBaseURL, clientID, clientSecret, refreshToken), "")
+	if err != nil {
+		return err
+	}
+	token := RequestToken{}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return err
+	}
+
+	if token.Status != 0 || token.Body.UserID == "" {
+		// An unusable refresh token grants nothing left to revoke.
+		log.Printf("The refresh token no longer works (status %d); only deleting the stored tokens.", token.Status)
+	} else {
+		body, err := withingsRequest(ctx, fmt.Sprintf("%s/v2/oauth2?action=revoke&userid=%s", withingsAPIBaseURL, token.Body.UserID), "")
+		if err != nil {
+			return err
+		}
+		var status struct {
+			Status int `json:"status"`
+		}
+		if err := json.Unmarshal(body, &status); err != nil {
+			return err
+		}
+		if status.Status != 0 {
+			return fmt.Errorf("revoke returned status %d", status.Status)
+		}
+		log.Printf("Revoked access to Withings user %s.", token.Body.UserID)
+	}
+
+	if store == nil {
+		return nil
+	}
+	if err := store.Delete(); err != nil {
+		return err
+	}
+	log.Printf("Deleted the tokens in %s.", store)
+	return nil
+}
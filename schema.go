@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// configSchema returns a JSON Schema for the YAML configuration file,
+// generated from the Config struct.
+func configSchema() map[string]interface{} {
+	schema := jsonSchema(reflect.TypeOf(Config{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "withings-exporter configuration"
+	return schema
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	if t == durationType {
+		// Go duration strings, e.g. 4h or 1h30m.
+		return map[string]interface{}{
+			"type":    "string",
+			"pattern": `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`,
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			properties[name] = jsonSchema(field.Type)
+		}
+		// The file is parsed strictly, so unknown keys are errors.
+		return map[string]interface{}{"type": "object", "properties": properties, "additionalProperties": false}
+	}
+
+	return map[string]interface{}{}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Series not produced by any collector (quota, process and Go runtime
+// metrics, derived metrics, ...) belong to this pseudo-collector.
+const exporterCollector = "exporter"
+
+// The collector producing each metric, for metrics without a type label.
+var metricCollectors = map[string]string{
+	"withings_current_weight":                           "weight",
+	"withings_bmi":                                      "weight",
+	"withings_weight_change_rate_kg_per_week":           "weight",
+	"withings_weight_trend_7d_kg":                       "weight",
+	"withings_weight_trend_30d_kg":                      "weight",
+	"withings_weight_change_kg":                         "weight",
+	"withings_weight_change_interval_seconds":           "weight",
+	"withings_current_hydration":                        "hydration",
+	"withings_hydration_kg":                             "hydration",
+	"withings_fat_ratio_percent":                        "fat_ratio",
+	"withings_fat_mass_kg":                              "fat_mass",
+	"withings_fat_free_mass_kg":                         "fat_free_mass",
+	"withings_muscle_mass_kg":                           "muscle_mass",
+	"withings_bone_mass_kg":                             "bone_mass",
+	"withings_heart_rate_bpm":                           "heart_rate",
+	"withings_spo2_percent":                             "spo2",
+	"withings_pulse_wave_velocity_meters_per_second":    "pulse_wave_velocity",
+	"withings_vascular_age_years":                       "vascular_age",
+	"withings_vo2max":                                   "vo2max",
+	"withings_visceral_fat":                             "visceral_fat",
+	"withings_blood_pressure_systolic_mmhg":             "blood_pressure",
+	"withings_blood_pressure_diastolic_mmhg":            "blood_pressure",
+	"withings_sleep_duration_seconds":                   "sleep",
+	"withings_sleep_deep_duration_seconds":              "sleep",
+	"withings_sleep_light_duration_seconds":             "sleep",
+	"withings_sleep_rem_duration_seconds":               "sleep",
+	"withings_sleep_wakeups":                            "sleep",
+	"withings_sleep_latency_seconds":                    "sleep",
+	"withings_sleep_heart_rate_average_bpm":             "sleep",
+	"withings_sleep_heart_rate_min_bpm":                 "sleep",
+	"withings_sleep_heart_rate_max_bpm":                 "sleep",
+	"withings_sleep_snoring_seconds":                    "sleep",
+	"withings_naps":                                     "sleep",
+	"withings_nap_duration_seconds":                     "sleep",
+	"withings_ecg_recordings_total":                     "ecg",
+	"withings_ecg_afib_last_detected_timestamp_seconds": "ecg",
+	"withings_heart_reading_heart_rate_bpm":             "ecg",
+	"withings_heart_reading_ecg_available":              "ecg",
+	"withings_raw_measurement":                          "raw",
+	"withings_objective":                                "objectives",
+	"withings_intraday_steps":                           "intraday",
+	"withings_intraday_calories":                        "intraday",
+	"withings_intraday_heart_rate_bpm":                  "intraday",
+	"withings_intraday_heart_rate_average_bpm":          "intraday",
+	"withings_intraday_heart_rate_distribution_bpm":     "intraday",
+	"withings_intraday_steps_distribution":              "intraday",
+	"withings_extracellular_water_kg":                   "bodyscan",
+	"withings_intracellular_water_kg":                   "bodyscan",
+	"withings_segment_fat_free_mass_kg":                 "bodyscan",
+	"withings_segment_fat_mass_kg":                      "bodyscan",
+	"withings_segment_muscle_mass_kg":                   "bodyscan",
+	"withings_devices":                                  "devices",
+	"withings_goal_weight_kg":                           "goals",
+	"withings_goal_steps":                               "goals",
+	"withings_goal_sleep_seconds":                       "goals",
+	"withings_goal_weight_remaining_kg":                 "goals",
+	"withings_goal_steps_progress_ratio":                "goals",
+	"withings_device_battery":                           "devices",
+	"withings_device_last_session_timestamp_seconds":    "devices",
+	"withings_steps_total":                              "activity",
+	"withings_distance_meters_total":                    "activity",
+	"withings_floors_climbed_total":                     "activity",
+	"withings_active_calories_total":                    "activity",
+	"withings_activity_soft_seconds_total":              "activity",
+	"withings_activity_moderate_seconds_total":          "activity",
+	"withings_activity_intense_seconds_total":           "activity",
+	"withings_daily_steps":                              "activity",
+	"withings_daily_distance_meters":                    "activity",
+	"withings_daily_floors_climbed":                     "activity",
+	"withings_daily_active_calories":                    "activity",
+	"withings_daily_activity_soft_seconds":              "activity",
+	"withings_daily_activity_moderate_seconds":          "activity",
+	"withings_daily_activity_intense_seconds":           "activity",
+	"withings_workouts_total":                           "workouts",
+	"withings_last_workout_duration_seconds":            "workouts",
+	"withings_last_workout_calories":                    "workouts",
+	"withings_last_workout_distance_meters":             "workouts",
+	"withings_last_workout_heart_rate_average_bpm":      "workouts",
+}
+
+// The collector producing each value of the type label, for metrics that
+// have one.
+var typeCollectors = map[string]string{
+	"weight":         "weight",
+	"bmi":            "weight",
+	"hydration":      "hydration",
+	"sleep_duration": "sleep",
+	"steps":          "activity",
+	"bp":             "ecg",
+	"fat_ratio":      "fat_ratio",
+	"fat_mass":       "fat_mass",
+	"fat_free_mass":  "fat_free_mass",
+	"muscle_mass":    "muscle_mass",
+	"bone_mass":      "bone_mass",
+}
+
+// collectorGatherer only returns the series produced by the given
+// collectors.
+type collectorGatherer struct {
+	prometheus.Gatherer
+	collectors []string
+}
+
+func (g collectorGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+
+	var kept []*dto.MetricFamily
+	for _, family := range families {
+		var metrics []*dto.Metric
+		for _, metric := range family.GetMetric() {
+			if contains(g.collectors, seriesCollector(family.GetName(), metric)) {
+				metrics = append(metrics, metric)
+			}
+		}
+
+		if len(metrics) > 0 {
+			family.Metric = metrics
+			kept = append(kept, family)
+		}
+	}
+
+	return kept, err
+}
+
+// seriesCollector returns the collector that produced a series.
+func seriesCollector(name string, metric *dto.Metric) string {
+	if collector, ok := metricCollectors[name]; ok {
+		return collector
+	}
+
+	for _, label := range metric.GetLabel() {
+		if label.GetName() != "type" && label.GetName() != "collector" {
+			continue
+		}
+		if collector, ok := typeCollectors[label.GetValue()]; ok {
+			return collector
+		}
+		if contains(collectors, label.GetValue()) {
+			return label.GetValue()
+		}
+	}
+
+	return exporterCollector
+}
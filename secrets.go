@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Environment variables holding secrets, which can instead be read from the
+// file named in the variable with a _FILE suffix, e.g. a Docker or
+// Kubernetes secret mounted as WITHINGS_API_CLIENT_SECRET_FILE.
+var secretEnvVars = []string{
+	"WITHINGS_API_CLIENT_ID",
+	"WITHINGS_API_CLIENT_SECRET",
+	"WITHINGS_API_REFRESH_TOKEN",
+	"GOOGLEFIT_CLIENT_SECRET",
+	"GOOGLEFIT_REFRESH_TOKEN",
+	"PUSH_REMOTE_WRITE_PASSWORD",
+	"CONSUL_HTTP_TOKEN",
+	"TOKEN_ENCRYPTION_KEY",
+	"VAULT_TOKEN",
+}
+
+// loadSecretFiles sets every secret environment variable with a _FILE
+// variant to the contents of that file, without the trailing newline.
+func loadSecretFiles() error {
+	for _, name := range secretEnvVars {
+		path := os.Getenv(name + "_FILE")
+		if path == "" {
+			continue
+		}
+		if os.Getenv(name) != "" {
+			return fmt.Errorf("both %s and %s_FILE are set", name, name)
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		os.Setenv(name, strings.TrimRight(string(data), "\r\n"))
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestSigner signs Withings API requests with the client secret, as some
+// actions require instead of (or on top of) an access token.
+// https://developer.withings.com/api-reference/#tag/signature
+type requestSigner struct {
+	clientID     string
+	clientSecret string
+}
+
+// signer signs requests for signedActions; it is set once the client
+// credentials are known.
+var signer *requestSigner
+
+// The actions that need a signature, keyed by path and action.
+var signedActions = map[string]bool{
+	"/notify subscribe": true,
+	"/notify revoke":    true,
+	"/notify update":    true,
+	"/notify get":       true,
+	"/notify list":      true,
+	"/v2/oauth2 revoke": true,
+	"/v2/user activate": true,
+	"/v2/user unlink":   true,
+}
+
+// signature returns the hex HMAC-SHA256 of the comma-separated values.
+func (s *requestSigner) signature(values ...string) string {
+	mac := hmac.New(sha256.New, []byte(s.clientSecret))
+	mac.Write([]byte(strings.Join(values, ",")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// nonce obtains a single-use nonce from the signature service.
+func (s *requestSigner) nonce(ctx context.Context) (string, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	url := fmt.Sprintf("%s/v2/signature?action=getnonce&client_id=%s&timestamp=%s&signature=%s",
+		withingsAPIBaseURL, s.clientID, timestamp, s.signature("getnonce", s.clientID, timestamp))
+
+	body, err := withingsRequest(ctx, url, "")
+	if err != nil {
+		return "", err
+	}
+
+	var response struct {
+		Status int `json:"status"`
+		Body   struct {
+			Nonce string `json:"nonce"`
+		} `json:"body"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", err
+	}
+	if response.Status != 0 || response.Body.Nonce == "" {
+		return "", fmt.Errorf("getnonce returned status %d", response.Status)
+	}
+	return response.Body.Nonce, nil
+}
+
+// sign adds the client_id, nonce and signature parameters to req, if its
+// action needs them.
+func (s *requestSigner) sign(ctx context.Context, req *http.Request) error {
+	query := req.URL.Query()
+	action := query.Get("action")
+	if !signedActions[req.URL.Path+" "+action] {
+		return nil
+	}
+
+	nonce, err := s.nonce(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot sign %s request: %v", action, err)
+	}
+	query.Set("client_id", s.clientID)
+	query.Set("nonce", nonce)
+	query.Set("signature", s.signature(action, s.clientID, nonce))
+	req.URL.RawQuery = query.Encode()
+	return nil
+}
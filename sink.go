@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// sampleSink receives every newly fetched sample of every account, e.g. to
+// forward it to another service.
+type sampleSink interface {
+	Name() string
+	Write(ctx context.Context, samples []Sample) error
+}
+
+// sinks are the configured sample sinks.
+var sinks []sampleSink
+
+// writeToSinks passes samples, which carry their account, to every
+// configured sink, logging failures.
+func writeToSinks(ctx context.Context, samples []Sample) {
+	if len(samples) == 0 {
+		return
+	}
+
+	for _, sink := range sinks {
+		if err := sink.Write(ctx, samples); err != nil {
+			log.Printf("Cannot write samples to %s: %v", sink.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Summary fields requested from getsummary.
+const sleepSummaryFields = "total_sleep_time,total_timeinbed,deepsleepduration,lightsleepduration,remsleepduration,wakeupcount,sleep_latency,hr_average,hr_min,hr_max,snoring,apnea_hypopnea_index,breathing_disturbances_intensity"
+
+// getSleepSummaries returns the summary of every sleep session on nights
+// between from and to.
+func getSleepSummaries(ctx context.Context, accessToken string, from time.Time, to time.Time) (*SleepSummary, error) {
+	all := &SleepSummary{}
+	offset := 0
+	for {
+		url := fmt.Sprintf("%s/v2/sleep?action=getsummary&startdateymd=%s&enddateymd=%s&data_fields=%s",
+			withingsAPIBaseURL, from.Format("2006-01-02"), to.Format("2006-01-02"), sleepSummaryFields)
+		if offset > 0 {
+			url += fmt.Sprintf("&offset=%d", offset)
+		}
+
+		key := userCacheKey(ctx, fmt.Sprintf("sleep-summary/%s_%s_%d.json", from.Format("2006-01-02"), to.Format("2006-01-02"), offset))
+		body, cached := apiCache.Get(key)
+		if !cached {
+			var err error
+			body, err = withingsRequest(ctx, url, accessToken)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		page := SleepSummary{}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		if page.Status != 0 {
+			return nil, fmt.Errorf("sleep summary returned status %d", page.Status)
+		}
+		if !cached && cacheable(to) {
+			apiCache.Put(key, body)
+		}
+
+		all.Body.Series = append(all.Body.Series, page.Body.Series...)
+		if !page.Body.More || page.Body.Offset <= offset {
+			return all, nil
+		}
+		offset = page.Body.Offset
+	}
+}
+
+// getSleep returns the high-frequency sleep data between start and end,
+// which may be at most 24 hours apart.
+func getSleep(ctx context.Context, accessToken string, start time.Time, end time.Time, fields string) (*Sleep, error) {
+	url := fmt.Sprintf("%s/v2/sleep?action=get&startdate=%d&enddate=%d&data_fields=%s", withingsAPIBaseURL, start.Unix(), end.Unix(), fields)
+	key := userCacheKey(ctx, fmt.Sprintf("sleep/%s/%d-%d_%s.json", start.Format("2006-01-02"), start.Unix(), end.Unix(), fields))
+	body, cached := apiCache.Get(key)
+	if !cached {
+		var err error
+		body, err = withingsRequest(ctx, url, accessToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sleep := &Sleep{}
+	if err := json.Unmarshal(body, sleep); err != nil {
+		return nil, err
+	}
+	if sleep.Status != 0 {
+		return nil, fmt.Errorf("sleep returned status %d", sleep.Status)
+	}
+	if !cached && cacheable(end) {
+		apiCache.Put(key, body)
+	}
+
+	return sleep, nil
+}
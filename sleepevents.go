@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SleepEvent is a single timestamped value of a breathing-related series.
+type SleepEvent struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// SleepNight is the breathing timeline of one sleep session, as written by
+// export-sleep-events.
+type SleepNight struct {
+	Date                           string    `json:"date"`
+	Start                          time.Time `json:"start"`
+	End                            time.Time `json:"end"`
+	ApneaHypopneaIndex             *float64  `json:"apnea_hypopnea_index,omitempty"`
+	BreathingDisturbancesIntensity *float64  `json:"breathing_disturbances_intensity,omitempty"`
+	// Respiration rate (breaths per minute) and snoring (seconds snored) over
+	// the night.
+	RespirationRate []SleepEvent `json:"respiration_rate"`
+	Snoring         []SleepEvent `json:"snoring"`
+}
+
+// exportSleepEvents writes the breathing timeline of every sleep session
+// between from and to into dir, one file per session.
+func exportSleepEvents(ctx context.Context, tokens *tokenSource, dir string, format string, from time.Time, to time.Time) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	summaries, err := getSleepSummaries(ctx, tokens.Token(ctx), from, to)
+	if err != nil {
+		return err
+	}
+
+	for _, summary := range summaries.Body.Series {
+		night := SleepNight{
+			Date:  summary.Date,
+			Start: time.Unix(summary.StartDate, 0),
+			End:   time.Unix(summary.EndDate, 0),
+		}
+		if v, ok := summary.Data["apnea_hypopnea_index"]; ok {
+			night.ApneaHypopneaIndex = &v
+		}
+		if v, ok := summary.Data["breathing_disturbances_intensity"]; ok {
+			night.BreathingDisturbancesIntensity = &v
+		}
+
+		sleep, err := getSleep(ctx, tokens.Token(ctx), night.Start, night.End, "rr,snoring")
+		if err != nil {
+			return err
+		}
+		for _, series := range sleep.Body.Series {
+			night.RespirationRate = append(night.RespirationRate, sleepEvents(series.RR)...)
+			night.Snoring = append(night.Snoring, sleepEvents(series.Snoring)...)
+		}
+		sortSleepEvents(night.RespirationRate)
+		sortSleepEvents(night.Snoring)
+
+		path := filepath.Join(dir, fmt.Sprintf("sleep-%s-%d.%s", summary.Date, summary.ID, format))
+		if err := writeSleepNight(path, format, night); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Exported %d sleep sessions to %s.", len(summaries.Body.Series), dir)
+	return nil
+}
+
+func sleepEvents(series map[string]float64) []SleepEvent {
+	var events []SleepEvent
+	for timestamp, value := range series {
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			continue
+		}
+		events = append(events, SleepEvent{Time: time.Unix(seconds, 0), Value: value})
+	}
+	return events
+}
+
+func sortSleepEvents(events []SleepEvent) {
+	sort.Slice(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+}
+
+func writeSleepNight(path string, format string, night SleepNight) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(night); err != nil {
+			return err
+		}
+	case "csv":
+		writer := csv.NewWriter(f)
+		writer.Write([]string{"time", "series", "value"})
+		for _, event := range night.RespirationRate {
+			writer.Write([]string{event.Time.Format(time.RFC3339), "respiration_rate", strconv.FormatFloat(event.Value, 'f', -1, 64)})
+		}
+		for _, event := range night.Snoring {
+			writer.Write([]string{event.Time.Format(time.RFC3339), "snoring", strconv.FormatFloat(event.Value, 'f', -1, 64)})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A metric exposing one field of the sleep summary of the latest night and
+// the latest nap, told apart by the kind label.
+type sleepSummaryMetric struct {
+	field string
+	gauge *prometheus.GaugeVec
+}
+
+func newSleepSummaryMetric(field string, name string, help string) sleepSummaryMetric {
+	return sleepSummaryMetric{field, prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, []string{"user", "kind"})}
+}
+
+var sleepSummaryMetrics = []sleepSummaryMetric{
+	newSleepSummaryMetric("total_sleep_time", "withings_sleep_duration_seconds", "Time asleep during the latest sleep session"),
+	newSleepSummaryMetric("deepsleepduration", "withings_sleep_deep_duration_seconds", "Time in deep sleep during the latest sleep session"),
+	newSleepSummaryMetric("lightsleepduration", "withings_sleep_light_duration_seconds", "Time in light sleep during the latest sleep session"),
+	newSleepSummaryMetric("remsleepduration", "withings_sleep_rem_duration_seconds", "Time in REM sleep during the latest sleep session"),
+	newSleepSummaryMetric("wakeupcount", "withings_sleep_wakeups", "Number of times woken up during the latest sleep session"),
+	newSleepSummaryMetric("sleep_latency", "withings_sleep_latency_seconds", "Time it took to fall asleep in the latest sleep session"),
+	newSleepSummaryMetric("hr_average", "withings_sleep_heart_rate_average_bpm", "Average heart rate during the latest sleep session"),
+	newSleepSummaryMetric("hr_min", "withings_sleep_heart_rate_min_bpm", "Lowest heart rate during the latest sleep session"),
+	newSleepSummaryMetric("hr_max", "withings_sleep_heart_rate_max_bpm", "Highest heart rate during the latest sleep session"),
+	newSleepSummaryMetric("snoring", "withings_sleep_snoring_seconds", "Time spent snoring during the latest sleep session"),
+}
+
+// updateSleepSummaryMetrics exposes the summaries of the latest night's
+// sleep (kind="night") and the latest nap (kind="nap") among summaries, so
+// naps don't count as a short night.
+func updateSleepSummaryMetrics(ctx context.Context, summaries *SleepSummary) {
+	latest := map[string]int{}
+	for i, summary := range summaries.Body.Series {
+		loc := sessionLocation(summary.Timezone)
+		kind := "night"
+		if isNap(time.Unix(summary.StartDate, 0).In(loc), time.Unix(summary.EndDate, 0).In(loc)) {
+			kind = "nap"
+		}
+		if j, ok := latest[kind]; !ok || summary.EndDate > summaries.Body.Series[j].EndDate {
+			latest[kind] = i
+		}
+	}
+
+	user := contextUser(ctx)
+	for _, kind := range []string{"night", "nap"} {
+		i, found := latest[kind]
+		for _, metric := range sleepSummaryMetrics {
+			if !found {
+				metric.gauge.DeleteLabelValues(user, kind)
+				continue
+			}
+			value, ok := summaries.Body.Series[i].Data[metric.field]
+			if !ok {
+				metric.gauge.DeleteLabelValues(user, kind)
+				continue
+			}
+			metric.gauge.WithLabelValues(user, kind).Set(value)
+		}
+	}
+
+	night, ok := latest["night"]
+	if !ok {
+		log.Println("No sleep summary for last night returned.")
+		return
+	}
+	log.Printf("Setting withings_sleep metrics for the night of %s.\n", summaries.Body.Series[night].Date)
+	recordMeasurementTime(ctx, "sleep_duration", time.Unix(summaries.Body.Series[night].EndDate, 0))
+}
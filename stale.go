@@ -0,0 +1,48 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	// Measurements older than this are stale, set with
+	// --max-measurement-age. Zero disables the staleness policy.
+	maxMeasurementAge time.Duration
+	// Whether stale measurements are left out of /metrics rather than
+	// flagged with withings_measurement_stale.
+	omitStaleMeasurements = false
+)
+
+// staleMeasurementGatherer leaves out the series of measurement metrics
+// whose latest measurement is older than maxMeasurementAge.
+type staleMeasurementGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g staleMeasurementGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+
+	lastMeasuredMu.Lock()
+	defer lastMeasuredMu.Unlock()
+
+	now := time.Now()
+	var kept []*dto.MetricFamily
+	for _, family := range families {
+		var metrics []*dto.Metric
+		for _, metric := range family.GetMetric() {
+			if t := seriesMeasurementTime(family.GetName(), metric); t.IsZero() || now.Sub(t) <= maxMeasurementAge {
+				metrics = append(metrics, metric)
+			}
+		}
+
+		if len(metrics) > 0 {
+			family.Metric = metrics
+			kept = append(kept, family)
+		}
+	}
+
+	return kept, err
+}
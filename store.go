@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sample is a single measurement kept in the local history store.
+type Sample struct {
+	// The account the sample belongs to. Stores written before there were
+	// several accounts leave it empty, which means the primary account.
+	User     string    `json:"user,omitempty"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Value    float64   `json:"value"`
+	Intraday bool      `json:"intraday,omitempty"`
+	// Anomalous is set when the sample failed the plausibility check against
+	// the one before it.
+	Anomalous bool `json:"anomalous,omitempty"`
+	// The device ID and source (device or manual) of measurements from the
+	// measure API.
+	DeviceID string `json:"deviceid,omitempty"`
+	Source   string `json:"source,omitempty"`
+}
+
+// HistoryStore keeps measurement history in memory, optionally persisted to a
+// JSON file, and prunes samples that fall outside the retention window.
+type HistoryStore struct {
+	mu                sync.Mutex
+	path              string
+	samples           []Sample
+	retention         time.Duration
+	intradayRetention time.Duration
+}
+
+// NewHistoryStore creates a history store. If path is non-empty, existing
+// history is loaded from it and every change is written back.
+func NewHistoryStore(path string, retention time.Duration, intradayRetention time.Duration) (*HistoryStore, error) {
+	s := &HistoryStore{
+		path:              path,
+		retention:         retention,
+		intradayRetention: intradayRetention,
+	}
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload replaces the in-memory history with the contents of the store's
+// file. It does nothing for memory-only stores.
+func (s *HistoryStore) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var samples []Sample
+	if err := json.Unmarshal(data, &samples); err != nil {
+		return err
+	}
+	for i := range samples {
+		if samples[i].User == "" {
+			samples[i].User = primaryUser
+		}
+	}
+
+	s.mu.Lock()
+	s.samples = samples
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Add records samples, replacing any existing sample of the same account and
+// type at the same time, and prunes anything that has expired. Samples
+// without a user belong to the primary account.
+func (s *HistoryStore) Add(samples ...Sample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sample := range samples {
+		if sample.User == "" {
+			sample.User = primaryUser
+		}
+		replaced := false
+		for i, existing := range s.samples {
+			if existing.User == sample.User && existing.Type == sample.Type && existing.Time.Equal(sample.Time) {
+				s.samples[i] = sample
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			s.samples = append(s.samples, sample)
+		}
+	}
+
+	sort.Slice(s.samples, func(i, j int) bool {
+		return s.samples[i].Time.Before(s.samples[j].Time)
+	})
+
+	s.prune(time.Now())
+
+	return s.save()
+}
+
+// Prune removes samples older than the retention window and returns how many
+// were removed.
+func (s *HistoryStore) Prune(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := s.prune(now)
+	if removed == 0 {
+		return 0, nil
+	}
+
+	return removed, s.save()
+}
+
+func (s *HistoryStore) prune(now time.Time) int {
+	kept := s.samples[:0]
+	for _, sample := range s.samples {
+		retention := s.retention
+		if sample.Intraday {
+			retention = s.intradayRetention
+		}
+		if retention > 0 && now.Sub(sample.Time) > retention {
+			continue
+		}
+		kept = append(kept, sample)
+	}
+
+	removed := len(s.samples) - len(kept)
+	s.samples = kept
+
+	return removed
+}
+
+// Samples returns the stored samples of the named account of the given type
+// between from and to (inclusive), oldest first.
+func (s *HistoryStore) Samples(user string, measurementType string, from time.Time, to time.Time) []Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []Sample
+	for _, sample := range s.samples {
+		if sample.User != user || sample.Type != measurementType || sample.Time.Before(from) || sample.Time.After(to) {
+			continue
+		}
+		result = append(result, sample)
+	}
+
+	return result
+}
+
+// Latest returns the most recent sample of the named account of the given
+// type.
+func (s *HistoryStore) Latest(user string, measurementType string) (Sample, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.samples) - 1; i >= 0; i-- {
+		if s.samples[i].User == user && s.samples[i].Type == measurementType {
+			return s.samples[i], true
+		}
+	}
+
+	return Sample{}, false
+}
+
+// All returns every stored sample, oldest first.
+func (s *HistoryStore) All() []Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Sample(nil), s.samples...)
+}
+
+func (s *HistoryStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.samples)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated store.
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Temperatures are fetched and stored in degrees Celsius, and exposed in the
+// unit set with temperature_unit in the config file.
+var temperatureTypes = map[string]string{
+	"body_temperature": "body temperature",
+	"skin_temperature": "skin temperature",
+}
+
+var temperatureMetrics = map[string]*prometheus.GaugeVec{}
+
+// setupTemperatureMetrics creates the temperature gauges, named after unit
+// (celsius if empty or fahrenheit).
+func setupTemperatureMetrics(unit string) error {
+	switch unit {
+	case "":
+		unit = "celsius"
+	case "celsius", "fahrenheit":
+	default:
+		return fmt.Errorf("unknown temperature unit %q; use celsius or fahrenheit", unit)
+	}
+
+	for measurementType, description := range temperatureTypes {
+		name := fmt.Sprintf("withings_%s_%s", measurementType, unit)
+		measurementMetricNames[measurementType] = name
+		metricCollectors[name] = measurementType
+		temperatureMetrics[measurementType] = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: name,
+				Help: fmt.Sprintf("Shows the latest %s measurement (in degrees %s)", description, unit),
+			},
+			[]string{"user"},
+		)
+	}
+
+	return nil
+}
+
+// exposedValue converts a stored value to the unit its metric is exposed in.
+func exposedValue(measurementType string, value float64) float64 {
+	if _, ok := temperatureTypes[measurementType]; ok && config.TemperatureUnit == "fahrenheit" {
+		return value*9/5 + 32
+	}
+	return value
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// useMeasurementTimestamps exposes measurement metrics with the time they
+// were measured rather than the scrape time, set with
+// --use-measurement-timestamps.
+var useMeasurementTimestamps = false
+
+// The measurement times recorded by collectors whose key differs from the
+// collector name.
+var measurementTimeKeys = map[string]string{
+	"blood_pressure": "bp",
+	"sleep":          "sleep_duration",
+}
+
+// measurementTimestampGatherer sets the timestamp of the series of
+// measurement metrics to the time of the latest measurement of their
+// collector.
+type measurementTimestampGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g measurementTimestampGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+
+	lastMeasuredMu.Lock()
+	defer lastMeasuredMu.Unlock()
+
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if t := seriesMeasurementTime(family.GetName(), metric); !t.IsZero() {
+				ms := t.UnixNano() / int64(time.Millisecond)
+				metric.TimestampMs = &ms
+			}
+		}
+	}
+
+	return families, err
+}
+
+// seriesMeasurementTime returns the time of the latest measurement a series
+// of a measurement metric reflects, or the zero time for other series. The
+// caller must hold lastMeasuredMu.
+func seriesMeasurementTime(name string, metric *dto.Metric) time.Time {
+	user, key, ok := seriesMeasurementKey(name, metric)
+	if !ok {
+		return time.Time{}
+	}
+	return lastMeasured[user][key]
+}
+
+// seriesMeasurementKey returns the user and the key of the measurement times
+// a series of a measurement metric reflects.
+func seriesMeasurementKey(name string, metric *dto.Metric) (string, string, bool) {
+	collector, ok := metricCollectors[name]
+	if !ok {
+		// Not a measurement, e.g. the days since the last one.
+		return "", "", false
+	}
+	key := collector
+	if k, ok := measurementTimeKeys[collector]; ok {
+		key = k
+	}
+
+	user := labelValue(metric, "user")
+	if user == "" {
+		user = primaryUser
+	}
+	return user, key, true
+}
+
+// metricsHandlerFor serves the metrics of gatherer, with device and source
+// labels if --metrics.device-labels is set, without measurements older than
+// --max-measurement-age if they are to be omitted, in imperial units with
+// --units=imperial, under their configured names, and with measurement
+// timestamps and OpenMetrics if --use-measurement-timestamps is set.
+func metricsHandlerFor(gatherer prometheus.Gatherer) http.Handler {
+	if deviceLabels {
+		gatherer = deviceLabelGatherer{gatherer}
+	}
+	if omitStaleMeasurements && maxMeasurementAge > 0 {
+		gatherer = staleMeasurementGatherer{gatherer}
+	}
+	opts := promhttp.HandlerOpts{}
+	if useMeasurementTimestamps {
+		gatherer = measurementTimestampGatherer{gatherer}
+		opts.EnableOpenMetrics = true
+	}
+	if imperialUnits {
+		gatherer = imperialGatherer{gatherer}
+	}
+	return promhttp.HandlerFor(renamingGatherer{gatherer}, opts)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// tokenSource hands out a valid access token, refreshing it when it has
+// expired. It is safe for concurrent use.
+type tokenSource struct {
+	mu sync.Mutex
+	// The account the tokens belong to, for the token metrics.
+	user         string
+	clientID     string
+	clientSecret string
+	accessToken  string
+	refreshToken string
+	expiry       time.Time
+	// If set, tokens are persisted to and restored from this store.
+	store tokenStore
+	// Whether the last refresh failed.
+	failed bool
+}
+
+// tokenStore persists the tokens of one account.
+type tokenStore interface {
+	// Load returns the stored tokens, or an error satisfying os.IsNotExist
+	// if there are none.
+	Load() (tokenState, error)
+	Save(state tokenState) error
+	// Delete removes the stored tokens.
+	Delete() error
+	// String describes where the tokens are stored, for log messages.
+	String() string
+}
+
+// fileTokenStore keeps tokens in a token file.
+type fileTokenStore struct {
+	path string
+}
+
+func (s fileTokenStore) Load() (tokenState, error) {
+	return readTokenState(s.path)
+}
+
+func (s fileTokenStore) Save(state tokenState) error {
+	return writeTokenState(s.path, state)
+}
+
+func (s fileTokenStore) Delete() error {
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s fileTokenStore) String() string {
+	return s.path
+}
+
+// tokenState is the contents of the token file.
+type tokenState struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+// defaultTokenFile returns the default --token-file,
+// ~/.config/withings-exporter/token.json on Linux.
+func defaultTokenFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "withings-exporter", "token.json")
+}
+
+// newTokenSource obtains tokens from store if it is not nil and holds any,
+// and otherwise by exchanging refreshToken. It fails if neither yields an
+// access token; the interactive flow is left to the auth command.
+func newTokenSource(user string, clientID string, clientSecret string, refreshToken string, store tokenStore) (*tokenSource, error) {
+	t := &tokenSource{user: user, clientID: clientID, clientSecret: clientSecret, store: store}
+	// Expose the counters from zero.
+	tokenRefreshesMetric.WithLabelValues(user)
+	tokenRefreshErrorsMetric.WithLabelValues(user)
+
+	var state tokenState
+	err := os.ErrNotExist
+	if store != nil {
+		state, err = store.Load()
+	}
+	if err == nil && state.RefreshToken != "" {
+		// The store holds the most recently issued tokens.
+		t.accessToken, t.refreshToken, t.expiry = state.AccessToken, state.RefreshToken, state.Expiry
+		t.Token(context.Background())
+		if time.Now().After(t.expiry) {
+			// The stored refresh token no longer works.
+			t.accessToken = ""
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot read tokens from %s: %v", store, err)
+	}
+
+	if t.accessToken == "" && refreshToken != "" {
+		t.refreshToken = refreshToken
+		t.Token(context.Background())
+	}
+
+	if t.accessToken == "" {
+		return nil, errors.New("no valid credentials; run `withings-exporter auth` first")
+	}
+	tokenExpiryMetric.WithLabelValues(user).Set(float64(t.expiry.Unix()))
+	authOKMetric.WithLabelValues(user).Set(1)
+
+	return t, nil
+}
+
+// authorize runs the interactive authorization flow and saves the tokens
+// in store. Without a store it prints the refresh token for use with
+// --api-refresh-token instead.
+func authorize(clientID string, clientSecret string, store tokenStore) error {
+	accessToken, refreshToken, expiry := oauthFlow(context.Background(), withingsAPIBaseURL, clientID, clientSecret, scopes, "", false)
+	if accessToken == "" {
+		return errors.New("no access token returned")
+	}
+
+	if store == nil {
+		fmt.Printf("Refresh token: %s\n", refreshToken)
+		return nil
+	}
+	if err := store.Save(tokenState{AccessToken: accessToken, RefreshToken: refreshToken, Expiry: expiry}); err != nil {
+		return err
+	}
+	log.Printf("Wrote credentials to %s.", store)
+	return nil
+}
+
+// Token returns the current access token, refreshing it first if needed.
+func (t *tokenSource) Token(ctx context.Context) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rejected := accessTokenRejected(t.user)
+	if rejected || time.Now().After(t.expiry) {
+		log.Println("Refreshing credentials...")
+		accessToken, refreshToken, expiry := oauthFlow(ctx, withingsAPIBaseURL, t.clientID, t.clientSecret, scopes, t.refreshToken, true)
+		if accessToken == "" {
+			// Keep the refresh token so the next call can try again.
+			log.Println("Cannot refresh credentials; retrying on the next request.")
+			tokenRefreshErrorsMetric.WithLabelValues(t.user).Inc()
+			t.failed = true
+			return t.accessToken
+		}
+		rejectedTokensMu.Lock()
+		delete(rejectedTokens, t.user)
+		rejectedTokensMu.Unlock()
+		t.failed = false
+		authOKMetric.WithLabelValues(t.user).Set(1)
+		tokenRefreshesMetric.WithLabelValues(t.user).Inc()
+		t.accessToken, t.expiry = accessToken, expiry
+		tokenExpiryMetric.WithLabelValues(t.user).Set(float64(expiry.Unix()))
+		if refreshToken != "" {
+			t.refreshToken = refreshToken
+		}
+		t.save()
+	}
+
+	return t.accessToken
+}
+
+// RefreshFailed reports whether the last attempt to refresh the access token
+// failed.
+func (t *tokenSource) RefreshFailed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failed
+}
+
+// Flush saves the current tokens, e.g. before exiting.
+func (t *tokenSource) Flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.save()
+}
+
+// save writes the current tokens to the store, if there is one.
+func (t *tokenSource) save() {
+	if t.store == nil || t.accessToken == "" {
+		return
+	}
+
+	state := tokenState{AccessToken: t.accessToken, RefreshToken: t.refreshToken, Expiry: t.expiry}
+	if err := t.store.Save(state); err != nil {
+		log.Printf("Cannot save tokens to %s: %v", t.store, err)
+	}
+}
+
+func readTokenState(path string) (tokenState, error) {
+	state := tokenState{}
+	if path == "" {
+		return state, os.ErrNotExist
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	data, err = decryptTokenState(data)
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func writeTokenState(path string, state tokenState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	data, err = encryptTokenState(data)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+var (
+	rejectedTokensMu sync.Mutex
+	// The users whose access token the API rejected before it expired, e.g.
+	// because they revoked and re-granted access. Their next Token call
+	// refreshes it.
+	rejectedTokens = map[string]bool{}
+)
+
+// rejectAccessToken notes that the API rejected the access token of the
+// account ctx collects data of.
+func rejectAccessToken(ctx context.Context) {
+	rejectedTokensMu.Lock()
+	defer rejectedTokensMu.Unlock()
+	rejectedTokens[contextUser(ctx)] = true
+}
+
+// accessTokenRejected reports whether the access token of user was rejected
+// since its last refresh.
+func accessTokenRejected(user string) bool {
+	rejectedTokensMu.Lock()
+	defer rejectedTokensMu.Unlock()
+	return rejectedTokens[user]
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// tokenEncryptionKey encrypts the token file with AES-256-GCM if set.
+var tokenEncryptionKey []byte
+
+// encryptedTokenState is the contents of an encrypted token file.
+type encryptedTokenState struct {
+	// Nonce followed by the sealed JSON token state.
+	Ciphertext []byte `json:"aes256gcm"`
+}
+
+// parseTokenEncryptionKey decodes a base64-encoded 32-byte key, as generated
+// by `openssl rand -base64 32`.
+func parseTokenEncryptionKey(key string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("token encryption key is not base64: %v", err)
+	}
+	if len(decoded) != 32 {
+		return nil, fmt.Errorf("token encryption key has %d bytes instead of 32", len(decoded))
+	}
+	return decoded, nil
+}
+
+func tokenCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(tokenEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptTokenState seals the JSON token state in data, if a key is set.
+func encryptTokenState(data []byte) ([]byte, error) {
+	if tokenEncryptionKey == nil {
+		return data, nil
+	}
+
+	gcm, err := tokenCipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(encryptedTokenState{Ciphertext: gcm.Seal(nonce, nonce, data, nil)})
+}
+
+// decryptTokenState returns the JSON token state in the token file contents
+// data. Plain files are accepted even with a key, so enabling encryption
+// does not need a new authorization; they are encrypted on the next write.
+func decryptTokenState(data []byte) ([]byte, error) {
+	encrypted := encryptedTokenState{}
+	if err := json.Unmarshal(data, &encrypted); err != nil || encrypted.Ciphertext == nil {
+		return data, nil
+	}
+	if tokenEncryptionKey == nil {
+		return nil, errors.New("token file is encrypted; set TOKEN_ENCRYPTION_KEY")
+	}
+
+	gcm, err := tokenCipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted.Ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("encrypted token file is truncated")
+	}
+	nonce, sealed := encrypted.Ciphertext[:gcm.NonceSize()], encrypted.Ciphertext[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errors.New("cannot decrypt token file; is TOKEN_ENCRYPTION_KEY the key it was written with?")
+	}
+	return plain, nil
+}
+
+// checkTokenDecryption reads the token file of every account, reporting
+// whether it can be decrypted with the configured key.
+func checkTokenDecryption(tokenFile string) bool {
+	ok := true
+	for _, name := range accountNames {
+		_, store, err := accountConfig(name, "", tokenFile)
+		if err == nil && store != nil {
+			_, err = store.Load()
+		}
+		switch {
+		case os.IsNotExist(err):
+			log.Printf("No token file for %s yet.", name)
+		case err != nil:
+			log.Printf("Token file of %s: %v", name, err)
+			ok = false
+		default:
+			log.Printf("Token file of %s is readable.", name)
+		}
+	}
+	return ok
+}
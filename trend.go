@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Default window of weight history the change rate is computed over.
+const defaultWeightTrendWindow = 28 * 24 * time.Hour
+
+// weightTrendWindow returns the configured window for the weight change rate.
+func weightTrendWindow() time.Duration {
+	if config.WeightTrendWindow > 0 {
+		return config.WeightTrendWindow
+	}
+	return defaultWeightTrendWindow
+}
+
+// changeRatePerWeek fits a least-squares line through the samples taken in
+// the window before now and returns its slope per week. It needs at least
+// two samples at different times.
+func changeRatePerWeek(samples []Sample, now time.Time, window time.Duration) (float64, bool) {
+	var n, sumX, sumY, sumXX, sumXY float64
+	for _, sample := range samples {
+		if now.Sub(sample.Time) > window || excludeAnomaly(sample) {
+			continue
+		}
+
+		// Weeks relative to now keep the numbers small.
+		x := sample.Time.Sub(now).Hours() / (24 * 7)
+		n++
+		sumX += x
+		sumY += sample.Value
+		sumXX += x * x
+		sumXY += x * sample.Value
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if n < 2 || denominator == 0 {
+		return 0, false
+	}
+
+	return (n*sumXY - sumX*sumY) / denominator, true
+}
+
+// updateWeightChangeRate sets withings_weight_change_rate_kg_per_week from
+// the weight history.
+func updateWeightChangeRate(ctx context.Context, samples []Sample) {
+	rate, ok := changeRatePerWeek(samples, time.Now(), weightTrendWindow())
+	if !ok {
+		return
+	}
+
+	log.Printf("Setting withings_weight_change_rate_kg_per_week metric to %.2f kg/week.\n", rate)
+	weightChangeRateMetric.WithLabelValues(contextUser(ctx)).Set(rate)
+}
+
+// The windows of the weight moving averages, with the gauge of each.
+var weightMovingAverages = []struct {
+	window time.Duration
+	gauge  *prometheus.GaugeVec
+}{
+	{7 * 24 * time.Hour, weightTrend7dMetric},
+	{30 * 24 * time.Hour, weightTrend30dMetric},
+}
+
+// liveHistoryWindow returns how much measurement history every poll
+// fetches: enough for the longest weight trend.
+func liveHistoryWindow() time.Duration {
+	window := weightTrendWindow()
+	for _, average := range weightMovingAverages {
+		if average.window > window {
+			window = average.window
+		}
+	}
+	return window
+}
+
+// movingAverage returns the mean of the samples taken in the window before
+// now.
+func movingAverage(samples []Sample, now time.Time, window time.Duration) (float64, bool) {
+	var n, sum float64
+	for _, sample := range samples {
+		if now.Sub(sample.Time) > window || excludeAnomaly(sample) {
+			continue
+		}
+		n++
+		sum += sample.Value
+	}
+
+	if n == 0 {
+		return 0, false
+	}
+	return sum / n, true
+}
+
+// updateWeightMovingAverages sets the smoothed weight trends from the weight
+// history, dropping those without samples in their window.
+func updateWeightMovingAverages(ctx context.Context, samples []Sample) {
+	user := contextUser(ctx)
+	now := time.Now()
+	for _, average := range weightMovingAverages {
+		value, ok := movingAverage(samples, now, average.window)
+		if !ok {
+			average.gauge.DeleteLabelValues(user)
+			continue
+		}
+		average.gauge.WithLabelValues(user).Set(math.Round(value*10) / 10)
+	}
+}
+
+// updateWeightChange sets withings_weight_change_kg and
+// withings_weight_change_interval_seconds from the two latest weight
+// measurements.
+func updateWeightChange(ctx context.Context, samples []Sample) {
+	var latest, previous *Sample
+	for i := range samples {
+		sample := &samples[i]
+		switch {
+		case latest == nil || sample.Time.After(latest.Time):
+			latest, previous = sample, latest
+		case previous == nil || sample.Time.After(previous.Time):
+			previous = sample
+		}
+	}
+	if previous == nil {
+		return
+	}
+
+	user := contextUser(ctx)
+	change := math.Round((latest.Value-previous.Value)*10) / 10
+	log.Printf("Setting withings_weight_change_kg metric to %.1f kg.\n", change)
+	weightChangeMetric.WithLabelValues(user).Set(change)
+	weightChangeIntervalMetric.WithLabelValues(user).Set(latest.Time.Sub(previous.Time).Seconds())
+}
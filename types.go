@@ -1,16 +1,19 @@
 package main
 
+import "encoding/json"
+
 // RequestToken response from Withings API
 // https://developer.withings.com/oauth2/#operation/oauth2-getaccesstoken
 type RequestToken struct {
 	Status int    `json:"status"`
 	Error  string `json:"error"`
 	Body   struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
-		Scope        string `json:"scope"`
-		ExpiresIn    int64  `json:"expires_in"`
-		TokenType    string `json:"token_type"`
+		AccessToken  string      `json:"access_token"`
+		RefreshToken string      `json:"refresh_token"`
+		Scope        string      `json:"scope"`
+		ExpiresIn    int64       `json:"expires_in"`
+		TokenType    string      `json:"token_type"`
+		UserID       json.Number `json:"userid"`
 	} `json:"body"`
 }
 
@@ -20,12 +23,179 @@ type Measures struct {
 	Status int `json:"status"`
 	Body   struct {
 		MeasureGroups []struct {
-			Date     int64 `json:"date"`
-			Created  int64 `json:"created"`
+			Date     int64  `json:"date"`
+			Created  int64  `json:"created"`
+			Attrib   int    `json:"attrib"`
+			DeviceID string `json:"deviceid"`
 			Measures []struct {
 				Value float64 `json:"value"`
 				Type  int     `json:"type"`
+				Unit  int     `json:"unit"`
+				// Set for segmental measures, e.g. of a Body Scan.
+				Position *int `json:"position"`
 			}
 		} `json:"measuregrps"`
+		More   int `json:"more"`
+		Offset int `json:"offset"`
+	} `json:"body"`
+}
+
+// HeartList response from Withings API
+// https://developer.withings.com/api-reference/#operation/heartv2-list
+type HeartList struct {
+	Status int `json:"status"`
+	Body   struct {
+		Series []struct {
+			DeviceID  string `json:"deviceid"`
+			Model     int    `json:"model"`
+			Timestamp int64  `json:"timestamp"`
+			HeartRate int    `json:"heart_rate"`
+			ECG       struct {
+				SignalID int64 `json:"signalid"`
+				AFib     int   `json:"afib"`
+			} `json:"ecg"`
+			BloodPressure struct {
+				Diastole int `json:"diastole"`
+				Systole  int `json:"systole"`
+			} `json:"bloodpressure"`
+		} `json:"series"`
+		More   bool `json:"more"`
+		Offset int  `json:"offset"`
+	} `json:"body"`
+}
+
+// HeartSignal response from Withings API
+// https://developer.withings.com/api-reference/#operation/heartv2-get
+type HeartSignal struct {
+	Status int `json:"status"`
+	Body   struct {
+		Signal            []int `json:"signal"`
+		SamplingFrequency int   `json:"sampling_frequency"`
+		WearPosition      int   `json:"wearposition"`
+	} `json:"body"`
+}
+
+// SleepSummary response from Withings API
+// https://developer.withings.com/api-reference/#operation/sleepv2-getsummary
+type SleepSummary struct {
+	Status int `json:"status"`
+	Body   struct {
+		Series []struct {
+			ID        int64              `json:"id"`
+			Timezone  string             `json:"timezone"`
+			Model     int                `json:"model"`
+			StartDate int64              `json:"startdate"`
+			EndDate   int64              `json:"enddate"`
+			Date      string             `json:"date"`
+			Data      map[string]float64 `json:"data"`
+		} `json:"series"`
+		More   bool `json:"more"`
+		Offset int  `json:"offset"`
+	} `json:"body"`
+}
+
+// Sleep response from Withings API. High-frequency series are keyed by Unix
+// timestamp.
+// https://developer.withings.com/api-reference/#operation/sleepv2-get
+type Sleep struct {
+	Status int `json:"status"`
+	Body   struct {
+		Series []struct {
+			StartDate int64              `json:"startdate"`
+			EndDate   int64              `json:"enddate"`
+			State     int                `json:"state"`
+			HR        map[string]float64 `json:"hr"`
+			RR        map[string]float64 `json:"rr"`
+			Snoring   map[string]float64 `json:"snoring"`
+		} `json:"series"`
+	} `json:"body"`
+}
+
+// Devices response from Withings API
+// https://developer.withings.com/api-reference/#operation/userv2-getdevice
+type Devices struct {
+	Status int `json:"status"`
+	Body   struct {
+		Devices []struct {
+			Type            string `json:"type"`
+			Model           string `json:"model"`
+			ModelID         int    `json:"model_id"`
+			Battery         string `json:"battery"`
+			DeviceID        string `json:"deviceid"`
+			Timezone        string `json:"timezone"`
+			LastSessionDate int64  `json:"last_session_date"`
+		} `json:"devices"`
+	} `json:"body"`
+}
+
+// Activity response from Withings API
+// https://developer.withings.com/api-reference/#operation/measurev2-getactivity
+type Activity struct {
+	Status int `json:"status"`
+	Body   struct {
+		Activities []struct {
+			Date      string  `json:"date"`
+			Timezone  string  `json:"timezone"`
+			Steps     float64 `json:"steps"`
+			Distance  float64 `json:"distance"`
+			Elevation float64 `json:"elevation"`
+			Calories  float64 `json:"calories"`
+			Soft      float64 `json:"soft"`
+			Moderate  float64 `json:"moderate"`
+			Intense   float64 `json:"intense"`
+		} `json:"activities"`
+		More   bool `json:"more"`
+		Offset int  `json:"offset"`
+	} `json:"body"`
+}
+
+// Workouts response from Withings API
+// https://developer.withings.com/api-reference/#operation/measurev2-getworkouts
+type Workouts struct {
+	Status int `json:"status"`
+	Body   struct {
+		Series []Workout `json:"series"`
+		More   bool      `json:"more"`
+		Offset int       `json:"offset"`
+	} `json:"body"`
+}
+
+// Workout is one entry of the Workouts response.
+type Workout struct {
+	ID        int64              `json:"id"`
+	Category  int                `json:"category"`
+	Timezone  string             `json:"timezone"`
+	StartDate int64              `json:"startdate"`
+	EndDate   int64              `json:"enddate"`
+	Date      string             `json:"date"`
+	Data      map[string]float64 `json:"data"`
+}
+
+// Goals response from Withings API
+// https://developer.withings.com/api-reference/#operation/userv2-getgoals
+type Goals struct {
+	Status int `json:"status"`
+	Body   struct {
+		Goals struct {
+			Steps  float64 `json:"steps"`
+			Sleep  float64 `json:"sleep"`
+			Weight struct {
+				Value float64 `json:"value"`
+				Unit  int     `json:"unit"`
+			} `json:"weight"`
+		} `json:"goals"`
+	} `json:"body"`
+}
+
+// IntradayActivity response from Withings API, keyed by Unix timestamp.
+// https://developer.withings.com/api-reference/#operation/measurev2-getintradayactivity
+type IntradayActivity struct {
+	Status int `json:"status"`
+	Body   struct {
+		Series map[string]struct {
+			Steps     float64 `json:"steps"`
+			HeartRate float64 `json:"heart_rate"`
+			Calories  float64 `json:"calories"`
+		} `json:"series"`
 	} `json:"body"`
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// unitVariant describes one unit a metric can additionally be exposed in.
+type unitVariant struct {
+	suffix string
+	// Factor converting from the measurement's base unit.
+	factor float64
+}
+
+// The variants exposed with --units.dual, keyed by base unit.
+var dualUnitVariants = map[string][]unitVariant{
+	"kg": {{"_kg", 1}, {"_lb", poundsPerKilogram}},
+	"m":  {{"_km", 0.001}, {"_mi", 1 / 1609.344}},
+}
+
+// How each base unit is spelled in metric names.
+var unitNameComponents = map[string]string{
+	"kg": "kg",
+	"m":  "meters",
+}
+
+// The base unit of each measurement type that has unit variants. Distances
+// outside the measurements, from the activity and workouts collectors, get
+// their variants in enableDualUnits.
+var measurementUnits = map[string]string{
+	"weight":        "kg",
+	"hydration":     "kg",
+	"fat_mass":      "kg",
+	"fat_free_mass": "kg",
+	"muscle_mass":   "kg",
+	"bone_mass":     "kg",
+}
+
+// dualUnitGauges holds the unit variant gauges of each measurement type; it
+// is only populated when --units.dual is set.
+var dualUnitGauges = map[string][]*prometheus.GaugeVec{}
+
+var dualUnitFactors = map[string][]float64{}
+
+// The unit variants of withings_last_workout_distance_meters, and the factors
+// converting to them.
+var (
+	workoutDistanceGauges  []*prometheus.GaugeVec
+	workoutDistanceFactors []float64
+)
+
+// dualUnitMetricName returns the name of a metric's unit variant: the unit in
+// the name is replaced, or appended to names that lack it.
+func dualUnitMetricName(base string, unit string, variant unitVariant) string {
+	parts := strings.Split(base, "_")
+	for i, part := range parts {
+		if part == unit || part == unitNameComponents[unit] {
+			parts[i] = variant.suffix[1:]
+			return strings.Join(parts, "_")
+		}
+	}
+	return base + variant.suffix
+}
+
+// enableDualUnits creates a metric per unit variant for every measurement
+// type with a known unit and for the activity and workout distances.
+func enableDualUnits() {
+	for measurementType, unit := range measurementUnits {
+		base := measurementMetricNames[measurementType]
+		for _, variant := range dualUnitVariants[unit] {
+			// Metrics already named after their unit only get the others.
+			name := dualUnitMetricName(base, unit, variant)
+			if name == base {
+				continue
+			}
+			metricCollectors[name] = measurementType
+			dualUnitGauges[measurementType] = append(dualUnitGauges[measurementType], prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: name,
+					Help: fmt.Sprintf("Shows the latest %s measurement (in %s)", measurementType, variant.suffix[1:]),
+				},
+				[]string{"user"},
+			))
+			dualUnitFactors[measurementType] = append(dualUnitFactors[measurementType], variant.factor)
+		}
+	}
+
+	for _, variant := range dualUnitVariants["m"] {
+		factor := variant.factor
+		name := dualUnitMetricName("withings_distance_meters_total", "m", variant)
+		metricCollectors[name] = "activity"
+		activityCounters = append(activityCounters, activityCounter{
+			prometheus.NewDesc(name, fmt.Sprintf("Distance travelled today, in %s; resets at the start of every day", variant.suffix[1:]), []string{"user"}, nil),
+			func(d activityDay) float64 { return math.Round(d.distance*factor*10) / 10 },
+		})
+
+		name = dualUnitMetricName("withings_last_workout_distance_meters", "m", variant)
+		metricCollectors[name] = "workouts"
+		workoutDistanceGauges = append(workoutDistanceGauges, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: name,
+				Help: fmt.Sprintf("Distance covered in the latest workout of the category (in %s)", variant.suffix[1:]),
+			},
+			[]string{"user", "category"},
+		))
+		workoutDistanceFactors = append(workoutDistanceFactors, factor)
+	}
+}
+
+// updateDualUnitMetrics sets every unit variant of a measurement from its
+// value in the base unit.
+func updateDualUnitMetrics(user string, measurementType string, value float64) {
+	for i, gauge := range dualUnitGauges[measurementType] {
+		gauge.WithLabelValues(user).Set(math.Round(value*dualUnitFactors[measurementType][i]*10) / 10)
+	}
+}
+
+// imperialUnits exposes mass and distance metrics in imperial units instead,
+// set with --units=imperial.
+var imperialUnits = false
+
+// imperialUnit replaces a metric unit with --units=imperial.
+type imperialUnit struct {
+	name string
+	// Factor converting from the metric unit.
+	factor float64
+}
+
+// The imperial units of the metric name components replaced with
+// --units=imperial.
+var imperialUnitReplacements = map[string]imperialUnit{
+	"kg":     {"lb", poundsPerKilogram},
+	"meters": {"miles", 1 / 1609.344},
+}
+
+// Mass metrics whose name lacks the unit.
+var unitlessMassMetrics = map[string]bool{
+	"withings_current_weight":    true,
+	"withings_current_hydration": true,
+}
+
+// Metrics labelled with the measurement type rather than named after its
+// unit, whose values --units=imperial converts by type.
+var typeLabelledMetrics = map[string]bool{
+	"withings_aggregate": true,
+	"withings_objective": true,
+}
+
+// imperialTypeFactor returns the factor converting the values of a
+// measurement type to imperial units.
+func imperialTypeFactor(measurementType string) (float64, bool) {
+	unit, ok := measurementUnits[measurementType]
+	if !ok {
+		return 1, false
+	}
+	replacement, ok := imperialUnitReplacements[unitNameComponents[unit]]
+	return replacement.factor, ok
+}
+
+// imperialValue converts a value to imperial units, rounded like the
+// measurement gauges.
+func imperialValue(value float64, factor float64) float64 {
+	return math.Round(value*factor*10) / 10
+}
+
+// imperialMetricName returns the name a metric is exposed under with
+// --units=imperial, and the factor converting its values.
+func imperialMetricName(name string) (string, float64, bool) {
+	if unitlessMassMetrics[name] {
+		return name + "_lb", poundsPerKilogram, true
+	}
+
+	parts := strings.Split(name, "_")
+	for i, part := range parts {
+		replacement, ok := imperialUnitReplacements[part]
+		// Speeds such as the pulse wave velocity keep their unit.
+		if !ok || (i+1 < len(parts) && parts[i+1] == "per" && part == "meters") {
+			continue
+		}
+		parts[i] = replacement.name
+		return strings.Join(parts, "_"), replacement.factor, true
+	}
+	return name, 1, false
+}
+
+// imperialGatherer converts the mass and distance metrics returned by
+// another gatherer to imperial units.
+type imperialGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g imperialGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+
+	for _, family := range families {
+		if typeLabelledMetrics[family.GetName()] {
+			for _, metric := range family.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() != "type" {
+						continue
+					}
+					if factor, ok := imperialTypeFactor(label.GetValue()); ok && metric.Gauge != nil {
+						value := imperialValue(metric.Gauge.GetValue(), factor)
+						metric.Gauge.Value = &value
+					}
+				}
+			}
+			continue
+		}
+
+		name, factor, ok := imperialMetricName(family.GetName())
+		if !ok {
+			continue
+		}
+		family.Name = &name
+		for _, metric := range family.GetMetric() {
+			switch {
+			case metric.Gauge != nil:
+				value := imperialValue(metric.Gauge.GetValue(), factor)
+				metric.Gauge.Value = &value
+			case metric.Counter != nil:
+				value := imperialValue(metric.Counter.GetValue(), factor)
+				metric.Counter.Value = &value
+			}
+		}
+	}
+
+	return families, err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDualUnitDistanceVariants(t *testing.T) {
+	enableDualUnits()
+
+	for _, name := range []string{
+		"withings_distance_km_total",
+		"withings_distance_mi_total",
+		"withings_last_workout_distance_km",
+		"withings_last_workout_distance_mi",
+	} {
+		if _, ok := metricCollectors[name]; !ok {
+			t.Errorf("no %s metric", name)
+		}
+	}
+
+	day := activityDay{distance: 5000}
+	want := map[string]float64{"withings_distance_km_total": 5, "withings_distance_mi_total": 3.1}
+	for _, counter := range activityCounters {
+		for name, value := range want {
+			if strings.Contains(counter.desc.String(), fmt.Sprintf("fqName: %q", name)) {
+				if got := counter.value(day); got != value {
+					t.Errorf("%s = %v, want %v", name, got, value)
+				}
+				delete(want, name)
+			}
+		}
+	}
+	for name := range want {
+		t.Errorf("no %s activity counter", name)
+	}
+}
+
+func TestDualUnitMetricName(t *testing.T) {
+	for _, tc := range []struct {
+		base, unit, want string
+		variant          unitVariant
+	}{
+		{"withings_current_weight", "kg", "withings_current_weight_lb", unitVariant{"_lb", poundsPerKilogram}},
+		{"withings_fat_mass_kg", "kg", "withings_fat_mass_lb", unitVariant{"_lb", poundsPerKilogram}},
+		{"withings_distance_meters_total", "m", "withings_distance_mi_total", unitVariant{"_mi", 1 / 1609.344}},
+		{"withings_height_m", "m", "withings_height_km", unitVariant{"_km", 0.001}},
+	} {
+		if got := dualUnitMetricName(tc.base, tc.unit, tc.variant); got != tc.want {
+			t.Errorf("dualUnitMetricName(%q, %q) = %q, want %q", tc.base, tc.unit, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// perCollectorUp enables withings_collector_up, set with
+// --metrics.collector-up.
+var perCollectorUp = false
+
+var (
+	collectorUpMu sync.Mutex
+	// Whether the last refresh of each collector succeeded, by user.
+	collectorUp = map[string]map[string]bool{}
+)
+
+// recordCollectorUp records whether the last refresh of the named collector
+// for the account ctx collects data of made only successful API requests, and
+// updates withings_up accordingly.
+func recordCollectorUp(ctx context.Context, name string, up bool) {
+	user := contextUser(ctx)
+
+	collectorUpMu.Lock()
+	defer collectorUpMu.Unlock()
+
+	if collectorUp[user] == nil {
+		collectorUp[user] = map[string]bool{}
+	}
+	collectorUp[user][name] = up
+
+	all := true
+	for _, ok := range collectorUp[user] {
+		all = all && ok
+	}
+	upMetric.WithLabelValues(user).Set(boolValue(all))
+	if perCollectorUp {
+		collectorUpMetric.WithLabelValues(user, name).Set(boolValue(up))
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
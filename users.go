@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The user label of the account authorized with the command line
+// credentials, when no accounts are configured.
+const defaultUser = "default"
+
+// primaryUser is the first configured account, or defaultUser. Store samples
+// and queries without a user refer to it.
+var primaryUser = defaultUser
+
+// accountNames lists the configured accounts, primaryUser first.
+var accountNames = []string{defaultUser}
+
+// account is a Withings account the exporter collects metrics for.
+type account struct {
+	name   string
+	tokens *tokenSource
+}
+
+type userContextKey struct{}
+
+// withUser returns a context collecting data of the named account.
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// contextUser returns the account ctx collects data of, primaryUser if unset.
+func contextUser(ctx context.Context) string {
+	if user, ok := ctx.Value(userContextKey{}).(string); ok {
+		return user
+	}
+	return primaryUser
+}
+
+// accountsMu guards accountNames and config.Accounts, which reloading the
+// configuration file changes.
+var accountsMu sync.Mutex
+
+// configuredAccounts returns accountNames.
+func configuredAccounts() []string {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	return accountNames
+}
+
+// setupAccounts sets primaryUser and accountNames from the accounts in the
+// configuration file, if any.
+func setupAccounts(accounts []AccountConfig) error {
+	names, err := validateAccounts(accounts)
+	if err != nil {
+		return err
+	}
+
+	primaryUser, accountNames = names[0], names
+	return nil
+}
+
+// validateAccounts returns the names of the accounts in the configuration
+// file, or just defaultUser if there are none.
+func validateAccounts(accounts []AccountConfig) ([]string, error) {
+	if len(accounts) == 0 {
+		return []string{defaultUser}, nil
+	}
+
+	names := []string{}
+	for _, a := range accounts {
+		if !metricNamePattern.MatchString(a.Name) {
+			return nil, fmt.Errorf("invalid account name %q", a.Name)
+		}
+		if contains(names, a.Name) {
+			return nil, fmt.Errorf("duplicate account %q", a.Name)
+		}
+		names = append(names, a.Name)
+	}
+	return names, nil
+}
+
+// accountTokenFile returns the token file of the named account: the one in
+// the configuration file, or tokenFile with the name appended, e.g.
+// token-alice.json.
+func accountTokenFile(tokenFile string, c AccountConfig) string {
+	if c.TokenFile != "" || tokenFile == "" {
+		return c.TokenFile
+	}
+	ext := filepath.Ext(tokenFile)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(tokenFile, ext), c.Name, ext)
+}
+
+// accountConfig returns the configuration of the named account and where
+// its tokens are stored: in Vault if it is configured, and otherwise in its
+// token file if any. Without accounts in the configuration file, the default
+// account uses the command line credentials.
+func accountConfig(name string, refreshToken string, tokenFile string) (AccountConfig, tokenStore, error) {
+	c := AccountConfig{Name: defaultUser, RefreshToken: refreshToken}
+	if len(config.Accounts) > 0 {
+		found := false
+		for _, a := range config.Accounts {
+			if a.Name == name {
+				c, found = a, true
+			}
+		}
+		if !found {
+			return c, nil, fmt.Errorf("unknown account %q", name)
+		}
+		tokenFile = accountTokenFile(tokenFile, c)
+	} else if name != defaultUser {
+		return c, nil, fmt.Errorf("unknown account %q", name)
+	}
+
+	switch {
+	case vault != nil:
+		return c, vaultTokenStore{path: vaultAccountPath(name)}, nil
+	case tokenFile != "":
+		return c, fileTokenStore{path: tokenFile}, nil
+	}
+	return c, nil, nil
+}
+
+// newAccountTokenSource obtains tokens for the named account.
+func newAccountTokenSource(clientID string, clientSecret string, name string, refreshToken string, tokenFile string) (*tokenSource, error) {
+	c, store, err := accountConfig(name, refreshToken, tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := newTokenSource(name, clientID, clientSecret, c.RefreshToken, store)
+	if err != nil && len(config.Accounts) > 0 {
+		err = fmt.Errorf("account %s: %v", name, err)
+	}
+	return tokens, err
+}
+
+// newAccounts obtains tokens for every configured account.
+func newAccounts(clientID string, clientSecret string, refreshToken string, tokenFile string) ([]account, error) {
+	var accounts []account
+	for _, name := range accountNames {
+		tokens, err := newAccountTokenSource(clientID, clientSecret, name, refreshToken, tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account{name: name, tokens: tokens})
+	}
+	return accounts, nil
+}
+
+// updateAccounts refreshes the named collectors of every account, recording
+// their samples in store if it is not nil.
+func updateAccounts(ctx context.Context, accounts []account, store *HistoryStore, names []string) {
+	for _, a := range accounts {
+		ctx := withUser(ctx, a.name)
+		updateCollectors(ctx, a.tokens.Token(ctx), store, names)
+		if !accessTokenRejected(a.name) {
+			continue
+		}
+
+		// Refresh the rejected token straight away rather than serving stale
+		// values until the next update.
+		log.Printf("Withings rejected the access token of %s; refreshing it.", a.name)
+		accessToken := a.tokens.Token(ctx)
+		if a.tokens.RefreshFailed() {
+			authOKMetric.WithLabelValues(a.name).Set(0)
+			log.Printf("Cannot refresh the credentials of %s, so its metrics are stale. Run `withings-exporter auth --user=%s` to authorize the exporter again.", a.name, a.name)
+			continue
+		}
+		updateCollectors(ctx, accessToken, store, names)
+	}
+}
+
+// userVec is a metric vector with a user label.
+type userVec interface {
+	prometheus.Collector
+	Delete(labels prometheus.Labels) bool
+}
+
+// userVecs lists the registered metric vectors, so the series of removed
+// accounts can be deleted.
+var userVecs []userVec
+
+// mustRegister registers c like prometheus.MustRegister, recording it in
+// userVecs if it is a metric vector.
+func mustRegister(c prometheus.Collector) {
+	if err := register(c); err != nil {
+		panic(err)
+	}
+}
+
+// register registers c like prometheus.Register, recording it in userVecs if
+// it is a metric vector, and its metric names for validateRenameTargets.
+func register(c prometheus.Collector) error {
+	if err := prometheus.Register(c); err != nil {
+		return err
+	}
+	recordMetricNames(c)
+	if vec, ok := c.(userVec); ok {
+		userVecs = append(userVecs, vec)
+	}
+	return nil
+}
+
+// deleteUser removes every series of the named account.
+func deleteUser(user string) {
+	for _, vec := range userVecs {
+		deleteUserSeries(vec, user)
+	}
+}
+
+// deleteUserSeries removes every series of vec labelled with user, e.g.
+// before exposing a new set of devices.
+func deleteUserSeries(vec userVec, user string) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+
+	var stale []prometheus.Labels
+	for metric := range ch {
+		pb := &dto.Metric{}
+		if err := metric.Write(pb); err != nil {
+			continue
+		}
+		labels := prometheus.Labels{}
+		for _, label := range pb.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		if labels["user"] == user {
+			stale = append(stale, labels)
+		}
+	}
+
+	for _, labels := range stale {
+		vec.Delete(labels)
+	}
+}
+
+// userGatherer only returns the series of one account, and series without a
+// user label.
+type userGatherer struct {
+	prometheus.Gatherer
+	user string
+}
+
+func (g userGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+
+	var kept []*dto.MetricFamily
+	for _, family := range families {
+		var metrics []*dto.Metric
+		for _, metric := range family.GetMetric() {
+			if user := labelValue(metric, "user"); user == "" || user == g.user {
+				metrics = append(metrics, metric)
+			}
+		}
+
+		if len(metrics) > 0 {
+			family.Metric = metrics
+			kept = append(kept, family)
+		}
+	}
+
+	return kept, err
+}
+
+// accountsGatherer drops the series of accounts that are no longer
+// configured, e.g. ones a custom collector still holds data of.
+type accountsGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g accountsGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	names := configuredAccounts()
+
+	var kept []*dto.MetricFamily
+	for _, family := range families {
+		var metrics []*dto.Metric
+		for _, metric := range family.GetMetric() {
+			if user := labelValue(metric, "user"); user == "" || contains(names, user) {
+				metrics = append(metrics, metric)
+			}
+		}
+
+		if len(metrics) > 0 {
+			family.Metric = metrics
+			kept = append(kept, family)
+		}
+	}
+
+	return kept, err
+}
+
+func labelValue(metric *dto.Metric, name string) string {
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultKV reads and writes secrets of a HashiCorp Vault KV version 2
+// engine. https://developer.hashicorp.com/vault/api-docs/secret/kv/kv-v2
+type vaultKV struct {
+	address string
+	token   string
+}
+
+// vault is the Vault configured with --vault.path, if any, and vaultPath
+// the secret holding the client credentials and tokens.
+var (
+	vault     *vaultKV
+	vaultPath string
+)
+
+// url returns the API URL of the secret at path, e.g. secret/withings for
+// the secret withings in the engine mounted at secret.
+func (v *vaultKV) url(path string) string {
+	mount, name := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		mount, name = path[:i], path[i+1:]
+	}
+	return fmt.Sprintf("%s/v1/%s/data/%s", strings.TrimSuffix(v.address, "/"), mount, name)
+}
+
+func (v *vaultKV) request(method string, path string, body interface{}) (*http.Response, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, v.url(path), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return http.DefaultClient.Do(req)
+}
+
+// Read returns the latest version of the secret at path; it is empty if
+// there is no such secret.
+func (v *vaultKV) Read(path string) (map[string]string, error) {
+	res, err := v.request("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return map[string]string{}, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned %s for %s", res.Status, path)
+	}
+
+	var secret struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&secret); err != nil {
+		return nil, err
+	}
+	if secret.Data.Data == nil {
+		// The latest version was deleted.
+		return map[string]string{}, nil
+	}
+	return secret.Data.Data, nil
+}
+
+// Write stores data as a new version of the secret at path.
+func (v *vaultKV) Write(path string, data map[string]string) error {
+	res, err := v.request("POST", path, map[string]interface{}{"data": data})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("vault returned %s for %s", res.Status, path)
+	}
+	return nil
+}
+
+// vaultAccountPath returns the secret holding the tokens of the named
+// account: vaultPath itself for the default account, and a secret below it
+// for configured accounts.
+func vaultAccountPath(name string) string {
+	if len(config.Accounts) == 0 {
+		return vaultPath
+	}
+	return vaultPath + "/" + name
+}
+
+// vaultTokenStore keeps tokens in the refresh_token, access_token and
+// expiry keys of a Vault secret, preserving its other keys.
+type vaultTokenStore struct {
+	path string
+}
+
+func (s vaultTokenStore) Load() (tokenState, error) {
+	data, err := vault.Read(s.path)
+	if err != nil {
+		return tokenState{}, err
+	}
+	if data["refresh_token"] == "" {
+		return tokenState{}, os.ErrNotExist
+	}
+
+	state := tokenState{AccessToken: data["access_token"], RefreshToken: data["refresh_token"]}
+	if data["expiry"] != "" {
+		state.Expiry, err = time.Parse(time.RFC3339, data["expiry"])
+	}
+	return state, err
+}
+
+func (s vaultTokenStore) Save(state tokenState) error {
+	data, err := vault.Read(s.path)
+	if err != nil {
+		return err
+	}
+
+	data["access_token"] = state.AccessToken
+	data["refresh_token"] = state.RefreshToken
+	data["expiry"] = state.Expiry.Format(time.RFC3339)
+	return vault.Write(s.path, data)
+}
+
+func (s vaultTokenStore) Delete() error {
+	data, err := vault.Read(s.path)
+	if err != nil {
+		return err
+	}
+
+	delete(data, "access_token")
+	delete(data, "refresh_token")
+	delete(data, "expiry")
+	return vault.Write(s.path, data)
+}
+
+func (s vaultTokenStore) String() string {
+	return "vault:" + s.path
+}
+
+// readVaultCredentials fills in the client credentials from the client_id
+// and client_secret keys of vaultPath, unless they were given otherwise.
+func readVaultCredentials(clientID *string, clientSecret *string) error {
+	if *clientID != "" && *clientSecret != "" {
+		return nil
+	}
+
+	data, err := vault.Read(vaultPath)
+	if err != nil {
+		return err
+	}
+	if *clientID == "" {
+		*clientID = data["client_id"]
+	}
+	if *clientSecret == "" {
+		*clientSecret = data["client_secret"]
+	}
+	return nil
+}
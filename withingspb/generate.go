@@ -0,0 +1,5 @@
+// Package withingspb contains the protobuf definitions of the exporter's gRPC
+// API.
+package withingspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative withings.proto
@@ -0,0 +1,178 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: withings.proto
+
+package withingspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Measurements_ListUsers_FullMethodName          = "/withings.v1.Measurements/ListUsers"
+	Measurements_StreamMeasurements_FullMethodName = "/withings.v1.Measurements/StreamMeasurements"
+)
+
+// MeasurementsClient is the client API for Measurements service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MeasurementsClient interface {
+	// ListUsers returns the users whose measurements are available.
+	ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (*ListUsersResponse, error)
+	// StreamMeasurements streams stored measurements, oldest first.
+	StreamMeasurements(ctx context.Context, in *StreamMeasurementsRequest, opts ...grpc.CallOption) (Measurements_StreamMeasurementsClient, error)
+}
+
+type measurementsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMeasurementsClient(cc grpc.ClientConnInterface) MeasurementsClient {
+	return &measurementsClient{cc}
+}
+
+func (c *measurementsClient) ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (*ListUsersResponse, error) {
+	out := new(ListUsersResponse)
+	err := c.cc.Invoke(ctx, Measurements_ListUsers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *measurementsClient) StreamMeasurements(ctx context.Context, in *StreamMeasurementsRequest, opts ...grpc.CallOption) (Measurements_StreamMeasurementsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Measurements_ServiceDesc.Streams[0], Measurements_StreamMeasurements_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &measurementsStreamMeasurementsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Measurements_StreamMeasurementsClient interface {
+	Recv() (*Measurement, error)
+	grpc.ClientStream
+}
+
+type measurementsStreamMeasurementsClient struct {
+	grpc.ClientStream
+}
+
+func (x *measurementsStreamMeasurementsClient) Recv() (*Measurement, error) {
+	m := new(Measurement)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MeasurementsServer is the server API for Measurements service.
+// All implementations must embed UnimplementedMeasurementsServer
+// for forward compatibility
+type MeasurementsServer interface {
+	// ListUsers returns the users whose measurements are available.
+	ListUsers(context.Context, *ListUsersRequest) (*ListUsersResponse, error)
+	// StreamMeasurements streams stored measurements, oldest first.
+	StreamMeasurements(*StreamMeasurementsRequest, Measurements_StreamMeasurementsServer) error
+	mustEmbedUnimplementedMeasurementsServer()
+}
+
+// UnimplementedMeasurementsServer must be embedded to have forward compatible implementations.
+type UnimplementedMeasurementsServer struct {
+}
+
+func (UnimplementedMeasurementsServer) ListUsers(context.Context, *ListUsersRequest) (*ListUsersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListUsers not implemented")
+}
+func (UnimplementedMeasurementsServer) StreamMeasurements(*StreamMeasurementsRequest, Measurements_StreamMeasurementsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamMeasurements not implemented")
+}
+func (UnimplementedMeasurementsServer) mustEmbedUnimplementedMeasurementsServer() {}
+
+// UnsafeMeasurementsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MeasurementsServer will
+// result in compilation errors.
+type UnsafeMeasurementsServer interface {
+	mustEmbedUnimplementedMeasurementsServer()
+}
+
+func RegisterMeasurementsServer(s grpc.ServiceRegistrar, srv MeasurementsServer) {
+	s.RegisterService(&Measurements_ServiceDesc, srv)
+}
+
+func _Measurements_ListUsers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListUsersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MeasurementsServer).ListUsers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Measurements_ListUsers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MeasurementsServer).ListUsers(ctx, req.(*ListUsersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Measurements_StreamMeasurements_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamMeasurementsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MeasurementsServer).StreamMeasurements(m, &measurementsStreamMeasurementsServer{stream})
+}
+
+type Measurements_StreamMeasurementsServer interface {
+	Send(*Measurement) error
+	grpc.ServerStream
+}
+
+type measurementsStreamMeasurementsServer struct {
+	grpc.ServerStream
+}
+
+func (x *measurementsStreamMeasurementsServer) Send(m *Measurement) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Measurements_ServiceDesc is the grpc.ServiceDesc for Measurements service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Measurements_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "withings.v1.Measurements",
+	HandlerType: (*MeasurementsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListUsers",
+			Handler:    _Measurements_ListUsers_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamMeasurements",
+			Handler:       _Measurements_StreamMeasurements_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "withings.proto",
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const workoutFields = "calories,effduration,distance,hr_average"
+
+// Names of the common workout categories, used as the category label.
+// Others are labelled with their number.
+var workoutCategories = map[int]string{
+	1:   "walk",
+	2:   "run",
+	3:   "hiking",
+	6:   "bicycling",
+	7:   "swimming",
+	12:  "tennis",
+	16:  "lift_weights",
+	17:  "calisthenics",
+	18:  "elliptical",
+	19:  "pilates",
+	21:  "soccer",
+	27:  "golf",
+	28:  "yoga",
+	29:  "dancing",
+	30:  "boxing",
+	34:  "skiing",
+	35:  "snowboarding",
+	36:  "other",
+	187: "rowing",
+	188: "zumba",
+	195: "climbing",
+	272: "multi_sport",
+	306: "indoor_walk",
+	307: "indoor_running",
+	308: "indoor_cycling",
+}
+
+func workoutCategory(category int) string {
+	if name, ok := workoutCategories[category]; ok {
+		return name
+	}
+	return strconv.Itoa(category)
+}
+
+// getWorkouts returns the workouts added or changed since the given time (or
+// every workout in the account, if it is zero).
+func getWorkouts(ctx context.Context, accessToken string, since time.Time) (*Workouts, error) {
+	all := &Workouts{}
+	offset := 0
+	for {
+		url := fmt.Sprintf("%s/v2/measure?action=getworkouts&data_fields=%s", withingsAPIBaseURL, workoutFields)
+		if !since.IsZero() {
+			url += fmt.Sprintf("&lastupdate=%d", since.Unix())
+		}
+		if offset > 0 {
+			url += fmt.Sprintf("&offset=%d", offset)
+		}
+
+		body, err := withingsRequest(ctx, url, accessToken)
+		if err != nil {
+			return nil, err
+		}
+
+		page := Workouts{}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		if page.Status != 0 {
+			return nil, fmt.Errorf("getworkouts returned status %d", page.Status)
+		}
+
+		all.Body.Series = append(all.Body.Series, page.Body.Series...)
+		if !page.Body.More || page.Body.Offset <= offset {
+			return all, nil
+		}
+		offset = page.Body.Offset
+	}
+}
+
+var workoutsDesc = prometheus.NewDesc(
+	"withings_workouts_total",
+	"Number of workouts recorded, by category",
+	[]string{"user", "category"}, nil,
+)
+
+var (
+	workoutCountsMu sync.Mutex
+	// Keyed by user, then by category.
+	workoutCounts = map[string]map[string]int{}
+	// The workouts fetched so far, keyed by user, then by ID.
+	knownWorkouts = map[string]map[int64]Workout{}
+	// When the workouts of each user were last fetched.
+	workoutsPolled = map[string]time.Time{}
+)
+
+// workoutsCollector exposes the number of workouts as a counter, so
+// increase() gives the workouts in a time range.
+type workoutsCollector struct{}
+
+func (workoutsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- workoutsDesc
+}
+
+func (workoutsCollector) Collect(ch chan<- prometheus.Metric) {
+	workoutCountsMu.Lock()
+	defer workoutCountsMu.Unlock()
+
+	for user, counts := range workoutCounts {
+		for category, count := range counts {
+			ch <- prometheus.MustNewConstMetric(workoutsDesc, prometheus.CounterValue, float64(count), user, category)
+		}
+	}
+}
+
+// updateWorkoutMetrics counts the workouts by category and exposes the
+// latest workout of each category. After the first poll, only the workouts
+// added or changed since the previous poll are fetched.
+func updateWorkoutMetrics(ctx context.Context, accessToken string) {
+	user := contextUser(ctx)
+	start := time.Now()
+	workoutCountsMu.Lock()
+	polled := workoutsPolled[user]
+	workoutCountsMu.Unlock()
+
+	workouts, err := getWorkouts(ctx, accessToken, polled)
+	if err != nil {
+		log.Printf("Cannot fetch workouts: %v", err)
+		return
+	}
+
+	workoutCountsMu.Lock()
+	known := knownWorkouts[user]
+	if known == nil {
+		known = map[int64]Workout{}
+		knownWorkouts[user] = known
+	}
+	for _, workout := range workouts.Body.Series {
+		known[workout.ID] = workout
+	}
+	workoutsPolled[user] = start
+
+	counts := map[string]int{}
+	latest := map[string]Workout{}
+	for _, workout := range known {
+		category := workoutCategory(workout.Category)
+		counts[category]++
+		if l, ok := latest[category]; !ok || workout.StartDate > l.StartDate {
+			latest[category] = workout
+		}
+	}
+	workoutCounts[user] = counts
+	total := len(known)
+	workoutCountsMu.Unlock()
+
+	for _, vec := range append([]*prometheus.GaugeVec{workoutDurationMetric, workoutCaloriesMetric, workoutDistanceMetric, workoutHeartRateMetric}, workoutDistanceGauges...) {
+		deleteUserSeries(vec, user)
+	}
+	for category, workout := range latest {
+		recordMeasurementTime(ctx, "workouts", time.Unix(workout.EndDate, 0))
+		duration, ok := workout.Data["effduration"]
+		if !ok {
+			duration = float64(workout.EndDate - workout.StartDate)
+		}
+		workoutDurationMetric.WithLabelValues(user, category).Set(duration)
+		if calories, ok := workout.Data["calories"]; ok {
+			workoutCaloriesMetric.WithLabelValues(user, category).Set(calories)
+		}
+		if distance, ok := workout.Data["distance"]; ok {
+			workoutDistanceMetric.WithLabelValues(user, category).Set(distance)
+			for i, gauge := range workoutDistanceGauges {
+				gauge.WithLabelValues(user, category).Set(math.Round(distance*workoutDistanceFactors[i]*10) / 10)
+			}
+		}
+		if heartRate, ok := workout.Data["hr_average"]; ok && heartRate > 0 {
+			workoutHeartRateMetric.WithLabelValues(user, category).Set(heartRate)
+		}
+	}
+
+	log.Printf("Setting withings_workouts_total metric for %d workouts.\n", total)
+}